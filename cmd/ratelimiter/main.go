@@ -1,34 +1,155 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/infra/access"
+	"github.com/mayckol/rate-limiter/internal/infra/breaker"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memcached"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
 	"github.com/mayckol/rate-limiter/internal/infra/cache/redispkg"
+	"github.com/mayckol/rate-limiter/internal/infra/httppkg/clientip"
 	"github.com/mayckol/rate-limiter/internal/infra/httppkg/webserver"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"github.com/mayckol/rate-limiter/internal/infra/logging"
+	"github.com/mayckol/rate-limiter/internal/infra/metrics"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"github.com/mayckol/rate-limiter/internal/infra/reload"
 	"github.com/mayckol/rate-limiter/internal/infra/repository"
-	"log"
+	"github.com/mayckol/rate-limiter/internal/infra/tracing"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
 )
 
 func main() {
 	conf, _, err := confpkg.LoadConfig()
 	if err != nil {
-		log.Fatalln(err)
+		fatal("loading the configuration failed", err)
 	}
 
-	cacheClient, err := redispkg.NewRedisClient(&redispkg.ClientSettings{
-		Host:     conf.RedisHost,
-		Port:     conf.RedisPort,
-		Password: conf.RedisCacheKey,
-		AppEnv:   conf.AppEnv,
+	logger, err := logging.New(os.Stdout, conf.LogFormat, conf.LogLevel)
+	if err != nil {
+		fatal("creating the logger failed", err)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), conf.TracingExporter)
+	if err != nil {
+		fatal("setting up tracing failed", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("flushing the spans failed", "error", err)
+		}
+	}()
+
+	stats := metrics.New()
+	cacheClient, err := newCacheClient(conf)
+	if err != nil {
+		fatal("connecting to the cache failed", err)
+	}
+	defer cacheClient.Close()
+	cacheBreaker := breaker.New(breaker.Settings{
+		Failures: conf.CacheBreakerFailures,
+		Cooldown: time.Duration(conf.CacheBreakerCooldownMs) * time.Millisecond,
+		OnStateChange: func(from, to breaker.State) {
+			level := slog.LevelWarn
+			if to == breaker.Closed {
+				level = slog.LevelInfo
+			}
+			logger.Log(context.Background(), level, "cache circuit breaker changed state", "from", from.String(), "to", to.String())
+			stats.Breaker(from, to)
+		},
 	})
+	cacheClient = tracing.Cache(cache.Guard(stats.Cache(cacheClient), cacheBreaker, time.Duration(conf.CacheTimeoutMs)*time.Millisecond))
 
-	// sample of how to use memcached or other cache client
-	//cacheClient, err := memcached.NewMemCachedClient(&memcached.ClientSettings{})
+	strategy, err := limiter.New(conf.RateLimitAlgorithm, cacheClient)
+	if err != nil {
+		fatal("RATE_LIMIT_ALGORITHM", err)
+	}
 
+	if _, err := clientip.NewResolver(conf.TrustedProxies); err != nil {
+		fatal("TRUSTED_PROXIES", err)
+	}
+	if _, err := policy.ParseKey(conf.RateLimitKey); err != nil {
+		fatal("RATE_LIMIT_KEY", err)
+	}
+
+	if _, err := access.ParseList(conf.Allowlist); err != nil {
+		fatal("ALLOWLIST", err)
+	}
+	if _, err := access.ParseList(conf.Denylist); err != nil {
+		fatal("DENYLIST", err)
+	}
+
+	var policies *policy.Set
+	if conf.PolicyFile != "" {
+		policies, err = policy.Load(conf.PolicyFile)
+		if err != nil {
+			fatal("POLICY_FILE", err)
+		}
+	}
+
+	requestRepository := repository.NewRequestRepository(cacheClient, strategy)
+	stats.Bans(requestRepository.ListBans)
+
+	// The policies failing over to the local limiter count the requests of this instance in memory while the cache
+	// backend fails.
+	localClient, err := memory.NewMemoryClient(&memory.ClientSettings{MaxEntries: conf.MemoryMaxEntries})
+	if err != nil {
+		fatal("creating the local limiter failed", err)
+	}
+	defer localClient.Close()
+	localStrategy, err := limiter.New(conf.RateLimitAlgorithm, localClient)
 	if err != nil {
-		log.Fatalln(err)
+		fatal("RATE_LIMIT_ALGORITHM", err)
 	}
+	failover := repository.NewFailoverRepository(requestRepository, repository.NewRequestRepository(localClient, localStrategy))
+	holder := policy.NewHolder(policies)
 
-	requestRepository := repository.NewRequestRepository(cacheClient)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloader := reload.NewReloader(holder, logger)
+	go reloader.Watch(ctx, time.Duration(conf.ConfigWatchIntervalMs)*time.Millisecond)
 
-	webserver.Start(requestRepository)
+	if err := webserver.Start(failover, requestRepository, holder, access.NewStore(cacheClient), stats, logger); err != nil {
+		fatal("the server stopped", err)
+	}
+}
+
+// fatal logs err with the default logger and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// newCacheClient returns the cache backend selected by CACHE_DRIVER, defaulting to Redis.
+func newCacheClient(conf *confpkg.Conf) (cache.ClientInterface, error) {
+	switch conf.CacheDriver {
+	case "", "redis":
+		return redispkg.NewRedisClient(&redispkg.ClientSettings{
+			Host:       conf.RedisHost,
+			Port:       conf.RedisPort,
+			Password:   conf.RedisCacheKey,
+			AppEnv:     conf.AppEnv,
+			MaxRetries: conf.RedisMaxRetries,
+		})
+	case "memory":
+		return memory.NewMemoryClient(&memory.ClientSettings{
+			MaxEntries: conf.MemoryMaxEntries,
+		})
+	case "memcached":
+		return memcached.NewMemCachedClient(&memcached.ClientSettings{
+			Servers: strings.Split(conf.MemcachedServers, ","),
+			Timeout: time.Duration(conf.CacheTimeoutMs) * time.Millisecond,
+		})
+	default:
+		return nil, fmt.Errorf("unknown cache driver: %s", conf.CacheDriver)
+	}
 }
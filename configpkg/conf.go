@@ -1,45 +1,280 @@
 package confpkg
 
 import (
+	"errors"
 	"fmt"
+	"github.com/joho/godotenv"
 	"github.com/mayckol/envsnatch"
 	"github.com/mayckol/rate-limiter/utils"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var Config *Conf
+// Values of TOKEN_LIMIT_PRECEDENCE, deciding how the requests carrying a valid token are limited.
+const (
+	// TokenPrecedenceToken counts them against the token identity with the token limit only.
+	TokenPrecedenceToken = "token"
+	// TokenPrecedenceIP ignores the token and counts them against the default key with DEFAULT_MAX_REQ_PER_SEC.
+	TokenPrecedenceIP = "ip"
+	// TokenPrecedenceBoth counts them against both, rejecting them when either limit is reached. It is the default.
+	TokenPrecedenceBoth = "both"
+)
+
+// Values of FAILURE_MODE and of the failure_mode of the rules, deciding the requests while the cache backend fails.
+const (
+	// FailureModeClosed rejects them with 503. It is the default.
+	FailureModeClosed = "closed"
+	// FailureModeOpen allows them without limit.
+	FailureModeOpen = "open"
+	// FailureModeLocal limits them with an in-memory limiter of each instance, to its share of the limit.
+	FailureModeLocal = "local"
+)
+
+// Values of TRACING_EXPORTER, deciding where the OpenTelemetry spans are sent.
+const (
+	// TracingExporterNone discards the spans. It is the default.
+	TracingExporterNone = "none"
+	// TracingExporterOTLP sends them to an OTLP collector over HTTP.
+	TracingExporterOTLP = "otlp"
+	// TracingExporterStdout writes them to the standard output, one JSON object per span.
+	TracingExporterStdout = "stdout"
+)
+
+// Values of LOG_FORMAT.
+const (
+	// LogFormatText writes the logs as key=value pairs. It is the default.
+	LogFormatText = "text"
+	// LogFormatJSON writes them as one JSON object per line.
+	LogFormatJSON = "json"
+)
+
+// current is the configuration in use, swapped atomically when the configuration is reloaded.
+var current atomic.Pointer[Conf]
 
 type Conf struct {
-	AppEnv              string `env:"APP_ENV"`
-	WSHost              string `env:"WS_HOST"`
-	JWTKey              string `env:"JWT_KEY"`
-	RedisHost           string `env:"REDIS_HOST"`
-	RedisPort           string `env:"REDIS_PORT"`
-	RedisCacheKey       string `env:"REDIS_CACHE_KEY"`
-	DefaultMaxReqPerSec int    `env:"DEFAULT_MAX_REQ_PER_SEC"`
-	TokenExpiresInSec   int    `env:"TOKEN_EXPIRES_IN_SEC"`
-	TimeoutDuration     int    `env:"TIMEOUT_DURATION"`
+	AppEnv                 string `env:"APP_ENV"`
+	WSHost                 string `env:"WS_HOST"`
+	JWTKey                 string `env:"JWT_KEY"`
+	CacheDriver            string `env:"CACHE_DRIVER,optional"`
+	RedisHost              string `env:"REDIS_HOST,optional"`
+	RedisPort              string `env:"REDIS_PORT,optional"`
+	RedisCacheKey          string `env:"REDIS_CACHE_KEY,optional"`
+	MemoryMaxEntries       int    `env:"MEMORY_MAX_ENTRIES,optional"`
+	MemcachedServers       string `env:"MEMCACHED_SERVERS,optional"`
+	RedisMaxRetries        int    `env:"REDIS_MAX_RETRIES,optional"`
+	CacheTimeoutMs         int    `env:"CACHE_TIMEOUT_MS,optional"`
+	CacheBreakerFailures   int    `env:"CACHE_BREAKER_FAILURES,optional"`
+	CacheBreakerCooldownMs int    `env:"CACHE_BREAKER_COOLDOWN_MS,optional"`
+	DefaultMaxReqPerSec    int    `env:"DEFAULT_MAX_REQ_PER_SEC"`
+	TokenExpiresInSec      int    `env:"TOKEN_EXPIRES_IN_SEC"`
+	TimeoutDuration        int    `env:"TIMEOUT_DURATION"`
+	RateLimitAlgorithm     string `env:"RATE_LIMIT_ALGORITHM,optional"`
+	TokenBucketBurst       int    `env:"TOKEN_BUCKET_BURST,optional"`
+	QueueSize              int    `env:"QUEUE_SIZE,optional"`
+	QueueMaxWaitMs         int    `env:"QUEUE_MAX_WAIT_MS,optional"`
+	RateLimitLegacyHeaders bool   `env:"RATE_LIMIT_LEGACY_HEADERS,optional"`
+	PolicyFile             string `env:"POLICY_FILE,optional"`
+	ConfigWatchIntervalMs  int    `env:"CONFIG_WATCH_INTERVAL_MS,optional"`
+	TrustedProxies         string `env:"TRUSTED_PROXIES,optional"`
+	IPv6PrefixLength       int    `env:"IPV6_PREFIX_LENGTH,optional"`
+	RateLimitKey           string `env:"RATE_LIMIT_KEY,optional"`
+	TokenLimitPrecedence   string `env:"TOKEN_LIMIT_PRECEDENCE,optional"`
+	BanExtendOnReject      bool   `env:"BAN_EXTEND_ON_REJECT,optional"`
+	PenaltyDurations       string `env:"PENALTY_DURATIONS,optional"`
+	PenaltyDecay           string `env:"PENALTY_DECAY,optional"`
+	Allowlist              string `env:"ALLOWLIST,optional"`
+	Denylist               string `env:"DENYLIST,optional"`
+	AdminToken             string `env:"ADMIN_TOKEN,optional"`
+	MetricsToken           string `env:"METRICS_TOKEN,optional"`
+	FailureMode            string `env:"FAILURE_MODE,optional"`
+	FailureLocalInstances  int    `env:"FAILURE_LOCAL_INSTANCES,optional"`
+	TracingExporter        string `env:"TRACING_EXPORTER,optional"`
+	LogFormat              string `env:"LOG_FORMAT,optional"`
+	LogLevel               string `env:"LOG_LEVEL,optional"`
+}
+
+// Validate reports the values that cannot be used even though they were parsed.
+func (c *Conf) Validate() error {
+	var errs []error
+	if c.DefaultMaxReqPerSec <= 0 {
+		errs = append(errs, errors.New("DEFAULT_MAX_REQ_PER_SEC must be greater than zero"))
+	}
+	if c.TokenExpiresInSec <= 0 {
+		errs = append(errs, errors.New("TOKEN_EXPIRES_IN_SEC must be greater than zero"))
+	}
+	if c.TimeoutDuration < 0 || c.TokenBucketBurst < 0 || c.QueueSize < 0 || c.QueueMaxWaitMs < 0 {
+		errs = append(errs, errors.New("TIMEOUT_DURATION, TOKEN_BUCKET_BURST, QUEUE_SIZE and QUEUE_MAX_WAIT_MS must not be negative"))
+	}
+	if c.RedisMaxRetries < 0 || c.CacheTimeoutMs < 0 || c.CacheBreakerFailures < 0 || c.CacheBreakerCooldownMs < 0 {
+		errs = append(errs, errors.New("REDIS_MAX_RETRIES, CACHE_TIMEOUT_MS, CACHE_BREAKER_FAILURES and CACHE_BREAKER_COOLDOWN_MS must not be negative"))
+	}
+	if c.IPv6PrefixLength < 0 || c.IPv6PrefixLength > 128 {
+		errs = append(errs, errors.New("IPV6_PREFIX_LENGTH must be between 0 and 128"))
+	}
+	if _, _, err := c.Penalties(); err != nil {
+		errs = append(errs, err)
+	}
+	switch c.TokenLimitPrecedence {
+	case "", TokenPrecedenceToken, TokenPrecedenceIP, TokenPrecedenceBoth:
+	default:
+		errs = append(errs, fmt.Errorf("TOKEN_LIMIT_PRECEDENCE must be %s, %s or %s", TokenPrecedenceToken, TokenPrecedenceIP, TokenPrecedenceBoth))
+	}
+	switch c.FailureMode {
+	case "", FailureModeClosed, FailureModeOpen, FailureModeLocal:
+	default:
+		errs = append(errs, fmt.Errorf("FAILURE_MODE must be %s, %s or %s", FailureModeClosed, FailureModeOpen, FailureModeLocal))
+	}
+	if c.FailureLocalInstances < 0 {
+		errs = append(errs, errors.New("FAILURE_LOCAL_INSTANCES must not be negative"))
+	}
+	switch c.TracingExporter {
+	case "", TracingExporterNone, TracingExporterOTLP, TracingExporterStdout:
+	default:
+		errs = append(errs, fmt.Errorf("TRACING_EXPORTER must be %s, %s or %s", TracingExporterNone, TracingExporterOTLP, TracingExporterStdout))
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("LOG_FORMAT must be %s or %s", LogFormatText, LogFormatJSON))
+	}
+	if c.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			errs = append(errs, errors.New("LOG_LEVEL must be debug, info, warn or error"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Penalties parses PENALTY_DURATIONS, a comma separated list of durations such as "10s,1m,10m,1h", and PENALTY_DECAY.
+func (c *Conf) Penalties() ([]time.Duration, time.Duration, error) {
+	var penalties []time.Duration
+	for _, s := range strings.Split(c.PenaltyDurations, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, 0, fmt.Errorf("PENALTY_DURATIONS: invalid duration %q", s)
+		}
+		penalties = append(penalties, d)
+	}
+
+	var decay time.Duration
+	if c.PenaltyDecay != "" {
+		d, err := time.ParseDuration(c.PenaltyDecay)
+		if err != nil || d < 0 {
+			return nil, 0, fmt.Errorf("PENALTY_DECAY: invalid duration %q", c.PenaltyDecay)
+		}
+		decay = d
+	}
+	return penalties, decay, nil
+}
+
+// Current returns the configuration in use. It may be replaced at any time by a reload, so callers handling a request
+// should read it once and keep the returned value.
+func Current() *Conf {
+	return current.Load()
 }
 
+// Activate makes conf the configuration returned by Current.
+func Activate(conf *Conf) {
+	current.Store(conf)
+}
+
+var (
+	mu       sync.Mutex
+	envFile  string
+	external map[string]bool
+	applied  map[string]bool
+)
+
 // LoadConfig loads the configuration from the .env file or .env.test file and returns the configuration and the invalid variables
 func LoadConfig(isTest ...bool) (*Conf, *[]envsnatch.UnmarshalingErr, error) {
-	path := utils.RootPath()
 	envType := ".env"
 	if isTest != nil && isTest[0] == true {
 		envType = ".env.test"
 	}
+	return LoadConfigFile(utils.RootPath() + "/" + envType)
+}
+
+// LoadConfigFile loads and activates the configuration from filename, which later calls to Read read again.
+func LoadConfigFile(filename string) (*Conf, *[]envsnatch.UnmarshalingErr, error) {
+	mu.Lock()
+	envFile = filename
+	mu.Unlock()
+
+	cfg, invalidVars, err := Read()
+	if invalidVars != nil {
+		for _, v := range *invalidVars {
+			slog.Error("invalid variable", "variable", v.Field, "reason", v.Reason)
+		}
+	}
+	if err != nil {
+		return nil, invalidVars, err
+	}
+
+	Activate(cfg)
+	return cfg, nil, nil
+}
+
+// Filename returns the .env file the configuration is read from.
+func Filename() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return envFile
+}
+
+// Read reads and validates the configuration from the .env file without activating it. Variables already set in the
+// environment before the first read take precedence over the file, on every read, while the ones coming from the file
+// follow its changes.
+func Read() (*Conf, *[]envsnatch.UnmarshalingErr, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if external == nil {
+		external = make(map[string]bool)
+		for _, env := range os.Environ() {
+			key, _, _ := strings.Cut(env, "=")
+			external[key] = true
+		}
+	}
+
+	values, err := godotenv.Read(envFile)
+	if err != nil {
+		slog.Info(".env not found, using environment variables instead", "file", envFile)
+	}
+
+	for key := range applied {
+		if _, ok := values[key]; !ok {
+			_ = os.Unsetenv(key)
+		}
+	}
+	applied = make(map[string]bool, len(values))
+	for key, value := range values {
+		if external[key] {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return nil, nil, err
+		}
+		applied[key] = true
+	}
+
 	es, _ := envsnatch.NewEnvSnatch()
-	es.AddPath(path)
-	es.AddFileName(envType)
 
 	var cfg Conf
 	invalidVars, err := es.Unmarshal(&cfg)
 	if invalidVars != nil {
-		for _, v := range *invalidVars {
-			fmt.Printf("invalid var: %s reason: %s\n", v.Field, v.Reason)
-		}
 		return nil, invalidVars, err
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
 
-	Config = &cfg
-	return &cfg, invalidVars, nil
+	return &cfg, nil, nil
 }
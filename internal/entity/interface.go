@@ -1,5 +1,113 @@
 package entity
 
+import (
+	"context"
+	"time"
+)
+
+// Decision is the outcome of checking a request against the rate limit.
+type Decision struct {
+	Allowed bool
+	// Limit is the number of requests allowed per window for the key.
+	Limit int
+	// Window is the time window the Limit refers to.
+	Window time.Duration
+	// Remaining is the number of requests the key can still perform in the current window.
+	Remaining int
+	// ResetAt is when the key is back to its full limit.
+	ResetAt time.Time
+	// RetryAfter is how long the client must wait before retrying. It is zero when the request is allowed.
+	RetryAfter time.Duration
+	// AdmitAt is when an allowed request may proceed. Queueing strategies may schedule it in the future; the zero value
+	// means right away.
+	AdmitAt time.Time
+	// Policy is the name of the policy the request was checked against.
+	Policy string
+	// Ban is the ban in effect on the key when the request was rejected because of it, or because it started it.
+	Ban *Ban
+	// FailureMode is the failure mode of the policy when the decision was taken by it because the cache backend
+	// failed, and empty otherwise.
+	FailureMode string
+}
+
+// Ban keeps a key rejected until it expires, regardless of its counter.
+type Ban struct {
+	Key string `json:"key"`
+	// Reason tells why the key was banned, such as BanReasonRateLimit.
+	Reason string `json:"reason"`
+	// Until is when the ban expires.
+	Until time.Time `json:"until"`
+	// Duration is how long the ban was started for, which extending it restarts.
+	Duration time.Duration `json:"duration"`
+	// Offenses is how many times the key was banned for exceeding its limit within the penalty decay window.
+	Offenses int `json:"offenses,omitempty"`
+}
+
+// Reasons of the bans.
+const (
+	// BanReasonRateLimit is the reason of the bans started by exceeding the rate limit.
+	BanReasonRateLimit = "rate_limit"
+	// BanReasonAdmin is the default reason of the bans started through the admin API.
+	BanReasonAdmin = "admin"
+)
+
+// Usage is the state of a key under a policy, read without counting a request.
+type Usage struct {
+	Key    string `json:"key"`
+	Policy string `json:"policy"`
+	Limit  int    `json:"limit"`
+	// Window is the time window the Limit refers to.
+	Window time.Duration `json:"window"`
+	// Used is how much of the Limit the key has consumed.
+	Used int `json:"used"`
+	// Remaining is the number of requests the key can perform right now.
+	Remaining int `json:"remaining"`
+	// ResetAt is when the key is back to its full limit.
+	ResetAt time.Time `json:"reset_at"`
+	// Ban is the ban in effect on the key, if any.
+	Ban *Ban `json:"ban,omitempty"`
+}
+
+// Policy is the rate limit applied to a group of requests.
+type Policy struct {
+	// Name identifies the policy in the decision and namespaces the keys of the requests it applies to.
+	Name string
+	// Algorithm is the limiter algorithm. The one configured by RATE_LIMIT_ALGORITHM is used when empty.
+	Algorithm string
+	// Limit is the number of requests allowed per Window.
+	Limit int
+	// Window is the time window the Limit refers to.
+	Window time.Duration
+	// Block is how long a key is banned after exceeding the limit. Zero only rejects the requests over the limit.
+	Block time.Duration
+	// ExtendBan restarts the ban on every request rejected while the key is banned.
+	ExtendBan bool
+	// Penalties replace Block by escalating durations: the nth ban of a key within PenaltyDecay lasts Penalties[n-1],
+	// the last one applying to every further ban.
+	Penalties []time.Duration
+	// PenaltyDecay is how long a key must go without being banned for its offenses to be forgotten.
+	PenaltyDecay time.Duration
+	// Burst is the number of requests allowed on top of Limit by the token bucket and GCRA.
+	Burst int
+	// QueueSize and MaxWait bound the queue of the leaky bucket.
+	QueueSize int
+	MaxWait   time.Duration
+	// FailureMode decides the requests while the cache backend fails: confpkg.FailureModeClosed rejects them,
+	// confpkg.FailureModeOpen allows them and confpkg.FailureModeLocal limits them locally. Empty means closed.
+	FailureMode string
+}
+
 type RequestRepositoryInterface interface {
-	CheckRateLimit(key string, limit int) (bool, error)
+	CheckRateLimit(ctx context.Context, key string, policy Policy) (*Decision, error)
+}
+
+// AdminRepositoryInterface inspects and changes the state of the rate limit keys outside of the requests.
+type AdminRepositoryInterface interface {
+	Usage(ctx context.Context, key string, policy Policy) (*Usage, error)
+	// Reset forgets the requests counted for key under policy by every algorithm, its ban and its offenses.
+	Reset(ctx context.Context, key string, policy Policy) error
+	Ban(ctx context.Context, key, reason string, d time.Duration) (*Ban, error)
+	Unban(ctx context.Context, key string) error
+	// ListBans returns the bans in effect.
+	ListBans(ctx context.Context) ([]Ban, error)
 }
@@ -0,0 +1,405 @@
+// Package access decides which clients bypass the rate limiter and which ones are refused outright, from allow and
+// deny lists of IPs, CIDRs and token subjects. The lists combine the static entries of the configuration with the ones
+// managed at runtime, which are stored in the cache backend so that every instance sees them.
+package access
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SubjectPrefix marks the entries matching the subject of the token instead of the client IP, as in "sub:health".
+const SubjectPrefix = "sub:"
+
+// Kinds of list.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Verdict is the outcome of the lists for a request.
+type Verdict int
+
+const (
+	// None means the request is rate limited as usual.
+	None Verdict = iota
+	// Allowed requests bypass the rate limiter.
+	Allowed
+	// Denied requests are refused without being counted.
+	Denied
+)
+
+// List matches clients by IP, CIDR or token subject.
+type List struct {
+	prefixes []netip.Prefix
+	subjects map[string]bool
+}
+
+// ParseList parses a comma separated list of IPs, CIDRs and subjects prefixed with "sub:", such as
+// "10.0.0.0/8, 192.168.1.10, sub:health".
+func ParseList(entries string) (*List, error) {
+	l := &List{}
+	for _, entry := range strings.Split(entries, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if err := l.add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *List) add(entry string) error {
+	if subject, ok := strings.CutPrefix(entry, SubjectPrefix); ok {
+		if subject == "" {
+			return fmt.Errorf("invalid access entry %q: empty subject", entry)
+		}
+		if l.subjects == nil {
+			l.subjects = make(map[string]bool)
+		}
+		l.subjects[subject] = true
+		return nil
+	}
+
+	prefix, err := parsePrefix(entry)
+	if err != nil {
+		return err
+	}
+	l.prefixes = append(l.prefixes, prefix)
+	return nil
+}
+
+// Match reports whether the client at ip, or the token subject when not empty, is on the list.
+func (l *List) Match(ip, subject string) bool {
+	if l == nil {
+		return false
+	}
+	if subject != "" && l.subjects[subject] {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize returns entry in the form it is stored and matched, validating it: CIDRs are masked and single IPs keep
+// their canonical form.
+func Normalize(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	if subject, ok := strings.CutPrefix(entry, SubjectPrefix); ok {
+		if subject == "" {
+			return "", fmt.Errorf("invalid access entry %q: empty subject", entry)
+		}
+		return entry, nil
+	}
+
+	prefix, err := parsePrefix(entry)
+	if err != nil {
+		return "", err
+	}
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String(), nil
+	}
+	return prefix.String(), nil
+}
+
+func parsePrefix(entry string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(entry)
+		if addrErr != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid access entry %q: expected an IP, a CIDR or %s<subject>", entry, SubjectPrefix)
+		}
+		addr = addr.Unmap()
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return prefix.Masked(), nil
+}
+
+type cached struct {
+	entries string
+	list    *List
+}
+
+// lists caches the last static list of each kind.
+var lists = map[string]*atomic.Pointer[cached]{Allow: {}, Deny: {}}
+
+// For returns the static List of entries, parsing them again only when they differ from the previous call for kind, so
+// it can be called on every request with the ALLOWLIST and DENYLIST of the current configuration. Invalid lists, which
+// the configuration validation rejects, match nothing.
+func For(kind, entries string) *List {
+	last := lists[kind]
+	if c := last.Load(); c != nil && c.entries == entries {
+		return c.list
+	}
+
+	l, err := ParseList(entries)
+	if err != nil {
+		l = &List{}
+	}
+	last.Store(&cached{entries: entries, list: l})
+	return l
+}
+
+// key holds the runtime entries of both lists in a single record, read once per request.
+const key = "rate_limiter_access"
+
+// Entry is a runtime entry of a list.
+type Entry struct {
+	Value string `json:"value"`
+	// Until is when the entry expires, nil for a permanent one.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+type record struct {
+	Allow []Entry `json:"allow,omitempty"`
+	Deny  []Entry `json:"deny,omitempty"`
+}
+
+func (r *record) entries(kind string) *[]Entry {
+	if kind == Allow {
+		return &r.Allow
+	}
+	return &r.Deny
+}
+
+// snapshotTTL bounds how long Check relies on the runtime entries it read last, so that the changes made through
+// another instance apply within it.
+const snapshotTTL = time.Second
+
+// snapshot holds the runtime lists read by Check until it expires.
+type snapshot struct {
+	allow, deny *List
+	expires     time.Time
+}
+
+// Store keeps the runtime entries of the lists in the cache backend.
+type Store struct {
+	client cache.ClientInterface
+	now    func() time.Time
+	last   atomic.Pointer[snapshot]
+}
+
+func NewStore(client cache.ClientInterface) *Store {
+	return &Store{client: client, now: time.Now}
+}
+
+// Add puts value on the list of kind for ttl, or permanently when ttl is zero, replacing the entry it already has.
+func (s *Store) Add(ctx context.Context, kind, value string, ttl time.Duration) (*Entry, error) {
+	if err := validKind(kind); err != nil {
+		return nil, err
+	}
+	if ttl < 0 {
+		return nil, errors.New("access: ttl must not be negative")
+	}
+	value, err := Normalize(value)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := Entry{Value: value}
+	if ttl > 0 {
+		until := time.UnixMilli(s.now().Add(ttl).UnixMilli())
+		entry.Until = &until
+	}
+	err = s.update(ctx, func(r *record) {
+		entries := r.entries(kind)
+		*entries = slices.DeleteFunc(*entries, func(e Entry) bool { return e.Value == value })
+		*entries = append(*entries, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Remove takes value off the list of kind, if it is there.
+func (s *Store) Remove(ctx context.Context, kind, value string) error {
+	if err := validKind(kind); err != nil {
+		return err
+	}
+	value, err := Normalize(value)
+	if err != nil {
+		return err
+	}
+	return s.update(ctx, func(r *record) {
+		entries := r.entries(kind)
+		*entries = slices.DeleteFunc(*entries, func(e Entry) bool { return e.Value == value })
+	})
+}
+
+// Entries returns the entries in effect on the list of kind.
+func (s *Store) Entries(ctx context.Context, kind string) ([]Entry, error) {
+	if err := validKind(kind); err != nil {
+		return nil, err
+	}
+	r, err := s.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return *r.entries(kind), nil
+}
+
+// CheckStatic returns the verdict of the static lists allow and deny alone for the client at ip with the token
+// subject, if any. Deny entries win over allow ones.
+func CheckStatic(allow, deny *List, ip, subject string) Verdict {
+	if deny.Match(ip, subject) {
+		return Denied
+	}
+	return verdict(allow.Match(ip, subject))
+}
+
+// Check returns the verdict of the static lists allow and deny, merged with the runtime ones, for the client at ip
+// with the token subject, if any. Deny entries win over allow ones. A nil Store checks the static lists only.
+func (s *Store) Check(ctx context.Context, allow, deny *List, ip, subject string) (Verdict, error) {
+	static := CheckStatic(allow, deny, ip, subject)
+	if static == Denied || s == nil {
+		return static, nil
+	}
+	allowed := static == Allowed
+
+	runtime, err := s.lists(ctx)
+	if err != nil {
+		return None, err
+	}
+	if runtime.deny.Match(ip, subject) {
+		return Denied, nil
+	}
+	return verdict(allowed || runtime.allow.Match(ip, subject)), nil
+}
+
+// lists returns the runtime lists, read from the cache backend at most once per snapshotTTL, and again as soon as an
+// entry expires or the lists change through s.
+func (s *Store) lists(ctx context.Context) (*snapshot, error) {
+	now := s.now()
+	if last := s.last.Load(); last != nil && now.Before(last.expires) {
+		return last, nil
+	}
+
+	r, err := s.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := list(r.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := list(r.Deny)
+	if err != nil {
+		return nil, err
+	}
+	next := &snapshot{allow: allow, deny: deny, expires: now.Add(snapshotTTL)}
+	for _, e := range append(slices.Clone(r.Allow), r.Deny...) {
+		if e.Until != nil && e.Until.Before(next.expires) {
+			next.expires = *e.Until
+		}
+	}
+	s.last.Store(next)
+	return next, nil
+}
+
+func verdict(allowed bool) Verdict {
+	if allowed {
+		return Allowed
+	}
+	return None
+}
+
+func list(entries []Entry) (*List, error) {
+	l := &List{}
+	for _, e := range entries {
+		if err := l.add(e.Value); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// read returns the runtime entries without the expired ones.
+func (s *Store) read(ctx context.Context) (*record, error) {
+	value, err := s.client.Get(ctx, key)
+	if errors.Is(err, cache.ErrNotFound) {
+		return &record{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.decode(value, true)
+}
+
+func (s *Store) decode(value string, found bool) (*record, error) {
+	r := &record{}
+	if !found {
+		return r, nil
+	}
+	if err := json.Unmarshal([]byte(value), r); err != nil {
+		return nil, fmt.Errorf("access: %w", err)
+	}
+	now := s.now()
+	expired := func(e Entry) bool { return e.Until != nil && !e.Until.After(now) }
+	r.Allow = slices.DeleteFunc(r.Allow, expired)
+	r.Deny = slices.DeleteFunc(r.Deny, expired)
+	return r, nil
+}
+
+// update applies fn to the runtime entries, dropping the expired ones, and stores them back until the last one
+// expires.
+func (s *Store) update(ctx context.Context, fn func(r *record)) error {
+	var fnErr error
+	err := cache.Update(ctx, s.client, key, func(value string, found bool) (string, time.Duration, bool) {
+		var r *record
+		if r, fnErr = s.decode(value, found); fnErr != nil {
+			return "", 0, false
+		}
+		fn(r)
+		if len(r.Allow) == 0 && len(r.Deny) == 0 {
+			return "", 0, found
+		}
+		var next []byte
+		if next, fnErr = json.Marshal(r); fnErr != nil {
+			return "", 0, false
+		}
+		return string(next), s.ttl(r), true
+	})
+	// The next Check reads the lists changed here from the backend.
+	s.last.Store(nil)
+	return errors.Join(err, fnErr)
+}
+
+// ttl returns how long the record has to be kept: until its last entry expires, or forever when one is permanent.
+func (s *Store) ttl(r *record) time.Duration {
+	var last time.Time
+	for _, e := range append(slices.Clone(r.Allow), r.Deny...) {
+		if e.Until == nil {
+			return cache.NoExpiration
+		}
+		if e.Until.After(last) {
+			last = *e.Until
+		}
+	}
+	return max(last.Sub(s.now()), time.Millisecond)
+}
+
+func validKind(kind string) error {
+	if kind != Allow && kind != Deny {
+		return fmt.Errorf("access: unknown list %q, expected %s or %s", kind, Allow, Deny)
+	}
+	return nil
+}
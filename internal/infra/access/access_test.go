@@ -0,0 +1,189 @@
+package access
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T) *Store {
+	client, err := memory.NewMemoryClient(&memory.ClientSettings{})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return NewStore(client)
+}
+
+func TestParseList(t *testing.T) {
+	l, err := ParseList("10.0.0.0/8, 192.168.1.10,2001:db8::/32, sub:health,,")
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip, subject string
+		match       bool
+	}{
+		{"10.1.2.3", "", true},
+		{"::ffff:10.1.2.3", "", true},
+		{"192.168.1.10", "", true},
+		{"192.168.1.11", "", false},
+		{"2001:db8:1::1", "", true},
+		{"2001:db9::1", "", false},
+		{"203.0.113.1", "health", true},
+		{"203.0.113.1", "other", false},
+		{"not an ip", "", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, l.Match(tt.ip, tt.subject), "%s %s", tt.ip, tt.subject)
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "example.com", "sub:"} {
+		_, err := ParseList(invalid)
+		assert.ErrorContains(t, err, "invalid access entry", invalid)
+	}
+
+	var none *List
+	assert.False(t, none.Match("10.1.2.3", "health"))
+}
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		" 10.1.2.3/8 ":      "10.0.0.0/8",
+		"::ffff:192.0.2.1":  "192.0.2.1",
+		"2001:DB8::1":       "2001:db8::1",
+		"sub:health":        "sub:health",
+		"2001:db8::1/128":   "2001:db8::1",
+		"2001:db8:0:1::/64": "2001:db8:0:1::/64",
+	}
+	for entry, expected := range tests {
+		normalized, err := Normalize(entry)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, normalized)
+	}
+
+	_, err := Normalize("bad")
+	assert.Error(t, err)
+}
+
+func TestFor(t *testing.T) {
+	l := For(Allow, "10.0.0.0/8")
+	assert.Same(t, l, For(Allow, "10.0.0.0/8"))
+	assert.True(t, l.Match("10.0.0.1", ""))
+	assert.False(t, For(Deny, "bad").Match("10.0.0.1", ""))
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Adds and removes entries", func(t *testing.T) {
+		store := newTestStore(t)
+
+		entry, err := store.Add(ctx, Deny, "203.0.113.0/24", 0)
+		require.NoError(t, err)
+		assert.Nil(t, entry.Until)
+		entry, err = store.Add(ctx, Allow, "sub:health", time.Minute)
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), *entry.Until, time.Second)
+
+		entries, err := store.Entries(ctx, Deny)
+		assert.NoError(t, err)
+		assert.Equal(t, []Entry{{Value: "203.0.113.0/24"}}, entries)
+
+		_, err = store.Add(ctx, Deny, "203.0.113.7/24", time.Hour)
+		require.NoError(t, err)
+		entries, err = store.Entries(ctx, Deny)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1, "an entry replaces the same one")
+
+		require.NoError(t, store.Remove(ctx, Deny, "203.0.113.0/24"))
+		entries, err = store.Entries(ctx, Deny)
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("Drops expired entries", func(t *testing.T) {
+		store := newTestStore(t)
+
+		_, err := store.Add(ctx, Allow, "10.0.0.1", time.Minute)
+		require.NoError(t, err)
+
+		store.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		entries, err := store.Entries(ctx, Allow)
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("Rejects invalid entries", func(t *testing.T) {
+		store := newTestStore(t)
+
+		_, err := store.Add(ctx, "maybe", "10.0.0.1", 0)
+		assert.ErrorContains(t, err, "unknown list")
+		_, err = store.Add(ctx, Allow, "bad", 0)
+		assert.ErrorContains(t, err, "invalid access entry")
+		_, err = store.Add(ctx, Allow, "10.0.0.1", -time.Second)
+		assert.ErrorContains(t, err, "must not be negative")
+	})
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	allow, err := ParseList("10.0.0.0/8, sub:health")
+	require.NoError(t, err)
+	deny, err := ParseList("10.6.6.6")
+	require.NoError(t, err)
+
+	t.Run("Checks the static lists", func(t *testing.T) {
+		assert.Equal(t, Allowed, CheckStatic(allow, deny, "10.0.0.1", ""))
+		assert.Equal(t, Allowed, CheckStatic(allow, deny, "203.0.113.1", "health"))
+		assert.Equal(t, Denied, CheckStatic(allow, deny, "10.6.6.6", ""), "deny entries win")
+		assert.Equal(t, None, CheckStatic(allow, deny, "203.0.113.1", ""))
+
+		var store *Store
+		verdict, err := store.Check(ctx, allow, deny, "10.0.0.1", "")
+		assert.NoError(t, err)
+		assert.Equal(t, Allowed, verdict, "a nil Store checks the static lists only")
+	})
+
+	t.Run("Merges the runtime entries", func(t *testing.T) {
+		store := newTestStore(t)
+
+		_, err := store.Add(ctx, Deny, "sub:abuser", 0)
+		require.NoError(t, err)
+		_, err = store.Add(ctx, Allow, "203.0.113.0/24", 0)
+		require.NoError(t, err)
+
+		verdict, err := store.Check(ctx, allow, deny, "10.0.0.1", "abuser")
+		assert.NoError(t, err)
+		assert.Equal(t, Denied, verdict)
+		verdict, _ = store.Check(ctx, allow, deny, "203.0.113.1", "")
+		assert.Equal(t, Allowed, verdict)
+		verdict, _ = store.Check(ctx, allow, deny, "198.51.100.1", "")
+		assert.Equal(t, None, verdict)
+	})
+
+	t.Run("Reads the runtime entries once per snapshot", func(t *testing.T) {
+		store := newTestStore(t)
+		now := time.Now()
+		store.now = func() time.Time { return now }
+		other := NewStore(store.client)
+
+		verdict, err := store.Check(ctx, allow, deny, "198.51.100.1", "")
+		require.NoError(t, err)
+		assert.Equal(t, None, verdict)
+
+		_, err = other.Add(ctx, Deny, "198.51.100.1", 0)
+		require.NoError(t, err)
+		verdict, _ = store.Check(ctx, allow, deny, "198.51.100.1", "")
+		assert.Equal(t, None, verdict, "changed through another instance")
+
+		now = now.Add(snapshotTTL)
+		verdict, _ = store.Check(ctx, allow, deny, "198.51.100.1", "")
+		assert.Equal(t, Denied, verdict)
+
+		require.NoError(t, store.Remove(ctx, Deny, "198.51.100.1"))
+		verdict, _ = store.Check(ctx, allow, deny, "198.51.100.1", "")
+		assert.Equal(t, None, verdict, "changed through the store itself")
+	})
+}
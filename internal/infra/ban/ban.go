@@ -0,0 +1,153 @@
+// Package ban stores the bans of the rate limit keys apart from their counters, so that a ban keeps its own reason and
+// expiry whatever the limiter algorithm.
+package ban
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPenaltyDecay is how long the offenses of a key are remembered when the policy sets penalties without a decay.
+const DefaultPenaltyDecay = 24 * time.Hour
+
+const (
+	// suffix is appended to a rate limit key to get the key of its ban record.
+	suffix = ":ban"
+	// offensesSuffix is appended to a rate limit key to get the key of its offense counter.
+	offensesSuffix = ":offenses"
+)
+
+type record struct {
+	Reason string `json:"reason"`
+	// Until is the expiry in unix milliseconds.
+	Until int64 `json:"until"`
+	// Duration is in milliseconds.
+	Duration int64 `json:"duration"`
+	Offenses int   `json:"offenses,omitempty"`
+}
+
+type Store struct {
+	client cache.ClientInterface
+	now    func() time.Time
+}
+
+func NewStore(client cache.ClientInterface) *Store {
+	return &Store{client: client, now: time.Now}
+}
+
+// Get returns the ban in effect on key, or nil when it is not banned.
+func (s *Store) Get(ctx context.Context, key string) (*entity.Ban, error) {
+	value, err := s.client.Get(ctx, key+suffix)
+	if errors.Is(err, cache.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var r record
+	if err := json.Unmarshal([]byte(value), &r); err != nil {
+		return nil, fmt.Errorf("ban %s: %w", key, err)
+	}
+
+	until := time.UnixMilli(r.Until)
+	if !until.After(s.now()) {
+		return nil, nil
+	}
+	return &entity.Ban{
+		Key:      key,
+		Reason:   r.Reason,
+		Until:    until,
+		Duration: time.Duration(r.Duration) * time.Millisecond,
+		Offenses: r.Offenses,
+	}, nil
+}
+
+// Ban bans key for d, replacing the ban in effect if any. offenses is recorded along with the ban, zero when it does
+// not result from a penalty.
+func (s *Store) Ban(ctx context.Context, key, reason string, d time.Duration, offenses int) (*entity.Ban, error) {
+	if d <= 0 {
+		return nil, fmt.Errorf("ban %s: duration must be greater than zero", key)
+	}
+
+	// Stored with millisecond precision, the expiry is returned as read back by Get.
+	until := time.UnixMilli(s.now().Add(d).UnixMilli())
+	value, err := json.Marshal(record{Reason: reason, Until: until.UnixMilli(), Duration: d.Milliseconds(), Offenses: offenses})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.client.Set(ctx, key+suffix, string(value), d); err != nil {
+		return nil, err
+	}
+	return &entity.Ban{Key: key, Reason: reason, Until: until, Duration: d, Offenses: offenses}, nil
+}
+
+// Lift removes the ban of key, if any. Its offenses are kept.
+func (s *Store) Lift(ctx context.Context, key string) error {
+	return s.client.Delete(ctx, key+suffix)
+}
+
+// Forgive forgets the offenses of key, so that its next ban starts the penalties over.
+func (s *Store) Forgive(ctx context.Context, key string) error {
+	return s.client.Delete(ctx, key+offensesSuffix)
+}
+
+// List returns the bans in effect, on backends implementing cache.Scanner. It returns cache.ErrNotSupported on the
+// other ones.
+func (s *Store) List(ctx context.Context) ([]entity.Ban, error) {
+	scanner, ok := s.client.(cache.Scanner)
+	if !ok {
+		return nil, cache.ErrNotSupported
+	}
+
+	bans := []entity.Ban{}
+	err := scanner.Scan(ctx, "*"+suffix, func(k string) error {
+		b, err := s.Get(ctx, strings.TrimSuffix(k, suffix))
+		if err != nil || b == nil {
+			// The ban expired or was lifted since it was scanned.
+			return err
+		}
+		bans = append(bans, *b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(bans, func(a, b entity.Ban) int { return strings.Compare(a.Key, b.Key) })
+	return bans, nil
+}
+
+// Offend records an offense of key and returns how many it has committed, the count being forgotten once decay passes
+// without any.
+func (s *Store) Offend(ctx context.Context, key string, decay time.Duration) (int, error) {
+	if decay <= 0 {
+		decay = DefaultPenaltyDecay
+	}
+
+	var offenses int
+	err := cache.Update(ctx, s.client, key+offensesSuffix, func(value string, found bool) (string, time.Duration, bool) {
+		offenses = 1
+		if n, err := strconv.Atoi(value); found && err == nil {
+			offenses = n + 1
+		}
+		return strconv.Itoa(offenses), decay, true
+	})
+	return offenses, err
+}
+
+// Penalty returns the duration of the ban of an offense under policy: the penalty of its rank, the last penalty past
+// them, or the policy Block when it has no penalties.
+func Penalty(policy entity.Policy, offenses int) time.Duration {
+	if len(policy.Penalties) == 0 {
+		return policy.Block
+	}
+	return policy.Penalties[min(max(offenses, 1), len(policy.Penalties))-1]
+}
@@ -0,0 +1,149 @@
+package ban
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T) (*Store, *memory.Client) {
+	client, err := memory.NewMemoryClient(&memory.ClientSettings{})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return NewStore(client), client
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Bans and lifts keys", func(t *testing.T) {
+		store, _ := newTestStore(t)
+
+		b, err := store.Get(ctx, "key")
+		assert.NoError(t, err)
+		assert.Nil(t, b)
+
+		created, err := store.Ban(ctx, "key", entity.BanReasonRateLimit, time.Minute, 0)
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), created.Until, time.Second)
+
+		b, err = store.Get(ctx, "key")
+		assert.NoError(t, err)
+		if assert.NotNil(t, b) {
+			assert.Equal(t, "key", b.Key)
+			assert.Equal(t, entity.BanReasonRateLimit, b.Reason)
+			assert.Equal(t, created.Until.UnixMilli(), b.Until.UnixMilli())
+		}
+
+		require.NoError(t, store.Lift(ctx, "key"))
+		b, err = store.Get(ctx, "key")
+		assert.NoError(t, err)
+		assert.Nil(t, b)
+	})
+
+	t.Run("Keeps bans apart from the counters", func(t *testing.T) {
+		store, client := newTestStore(t)
+
+		_, err := store.Ban(ctx, "key", "manual", time.Minute, 0)
+		require.NoError(t, err)
+		require.NoError(t, client.Set(ctx, "key", "1", time.Minute))
+
+		b, err := store.Get(ctx, "key")
+		assert.NoError(t, err)
+		assert.NotNil(t, b)
+	})
+
+	t.Run("Ignores expired bans", func(t *testing.T) {
+		store, _ := newTestStore(t)
+		now := time.Now()
+		store.now = func() time.Time { return now }
+
+		_, err := store.Ban(ctx, "key", "manual", time.Minute, 0)
+		require.NoError(t, err)
+
+		store.now = func() time.Time { return now.Add(time.Minute) }
+		b, err := store.Get(ctx, "key")
+		assert.NoError(t, err)
+		assert.Nil(t, b)
+	})
+
+	t.Run("Rejects non-positive durations", func(t *testing.T) {
+		store, _ := newTestStore(t)
+
+		_, err := store.Ban(ctx, "key", "manual", 0, 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestOffend(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestStore(t)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	for i := 1; i <= 3; i++ {
+		offenses, err := store.Offend(ctx, "key", 50*time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, i, offenses)
+	}
+
+	offenses, err := store.Offend(ctx, "other", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 1, offenses)
+
+	time.Sleep(100 * time.Millisecond)
+	offenses, err = store.Offend(ctx, "key", 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, 1, offenses, "offenses must be forgotten after the decay")
+	require.NoError(t, store.Forgive(ctx, "other"))
+	offenses, err = store.Offend(ctx, "other", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 1, offenses, "forgiven offenses start over")
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	store, client := newTestStore(t)
+
+	bans, err := store.List(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, bans)
+
+	_, err = store.Ban(ctx, "rate_limiter_b", entity.BanReasonRateLimit, time.Minute, 2)
+	require.NoError(t, err)
+	_, err = store.Ban(ctx, "rate_limiter_a", "manual", time.Hour, 0)
+	require.NoError(t, err)
+	_, err = store.Offend(ctx, "rate_limiter_c", time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, client.Set(ctx, "rate_limiter_c", "1", time.Minute))
+
+	bans, err = store.List(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, bans, 2) {
+		assert.Equal(t, "rate_limiter_a", bans[0].Key)
+		assert.Equal(t, "manual", bans[0].Reason)
+		assert.Equal(t, "rate_limiter_b", bans[1].Key)
+		assert.Equal(t, 2, bans[1].Offenses)
+	}
+
+	_, err = NewStore(struct{ cache.ClientInterface }{client}).List(ctx)
+	assert.ErrorIs(t, err, cache.ErrNotSupported)
+}
+
+func TestPenalty(t *testing.T) {
+	policy := entity.Policy{Block: 5 * time.Second}
+	assert.Equal(t, 5*time.Second, Penalty(policy, 3))
+
+	policy.Penalties = []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute, time.Hour}
+	assert.Equal(t, 10*time.Second, Penalty(policy, 0))
+	assert.Equal(t, 10*time.Second, Penalty(policy, 1))
+	assert.Equal(t, time.Minute, Penalty(policy, 2))
+	assert.Equal(t, time.Hour, Penalty(policy, 4))
+	assert.Equal(t, time.Hour, Penalty(policy, 9))
+}
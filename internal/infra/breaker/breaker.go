@@ -0,0 +1,156 @@
+// Package breaker implements a circuit breaker: after a number of consecutive failures it opens and refuses the calls
+// for a cooldown, then lets a single probe through, closing again when the probe succeeds and reopening otherwise.
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned by Allow while the breaker refuses the calls.
+var ErrOpen = errors.New("circuit breaker is open")
+
+const (
+	// DefaultFailures is how many consecutive failures open the breaker when Settings.Failures is not set.
+	DefaultFailures = 5
+	// DefaultCooldown is how long the breaker stays open when Settings.Cooldown is not set.
+	DefaultCooldown = 5 * time.Second
+)
+
+// State is the state of a breaker.
+type State int
+
+const (
+	// Closed lets every call through.
+	Closed State = iota
+	// HalfOpen lets a single probe through after the cooldown.
+	HalfOpen
+	// Open refuses every call.
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half_open"
+	case Open:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// Outcome is the result of a call let through by the breaker.
+type Outcome int
+
+const (
+	Success Outcome = iota
+	Failure
+	// Ignored calls say nothing about the health of the dependency, such as the ones canceled by their caller.
+	Ignored
+)
+
+type Settings struct {
+	// Failures is how many consecutive failures open the breaker.
+	Failures int
+	// Cooldown is how long the breaker stays open before probing.
+	Cooldown time.Duration
+	// OnStateChange is called on every transition, outside of the lock of the breaker.
+	OnStateChange func(from, to State)
+}
+
+type Breaker struct {
+	failures      int
+	cooldown      time.Duration
+	onStateChange func(from, to State)
+	// now is replaced by the tests.
+	now func() time.Time
+
+	mu          sync.Mutex
+	state       State
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+}
+
+func New(settings Settings) *Breaker {
+	failures, cooldown := settings.Failures, settings.Cooldown
+	if failures <= 0 {
+		failures = DefaultFailures
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+	return &Breaker{failures: failures, cooldown: cooldown, onStateChange: settings.OnStateChange, now: time.Now}
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow returns ErrOpen when the call must be refused. Otherwise the call may proceed and done must be called with its
+// outcome once it returns.
+func (b *Breaker) Allow() (done func(Outcome), err error) {
+	b.mu.Lock()
+	from := b.state
+	switch {
+	case b.state == Open && b.now().Sub(b.openedAt) >= b.cooldown:
+		b.state = HalfOpen
+		b.probing = true
+	case b.state == Open, b.state == HalfOpen && b.probing:
+		b.mu.Unlock()
+		return nil, ErrOpen
+	case b.state == HalfOpen:
+		b.probing = true
+	}
+	to := b.state
+	b.mu.Unlock()
+
+	b.notify(from, to)
+	return b.done(to == HalfOpen), nil
+}
+
+// done returns the function recording the outcome of a call, a probe when probe is set.
+func (b *Breaker) done(probe bool) func(Outcome) {
+	var once sync.Once
+	return func(outcome Outcome) {
+		once.Do(func() { b.record(probe, outcome) })
+	}
+}
+
+func (b *Breaker) record(probe bool, outcome Outcome) {
+	b.mu.Lock()
+	from := b.state
+	if probe {
+		b.probing = false
+	}
+	switch outcome {
+	case Success:
+		b.consecutive = 0
+		if probe {
+			b.state = Closed
+		}
+	case Failure:
+		b.consecutive++
+		if probe || b.state == Closed && b.consecutive >= b.failures {
+			b.state = Open
+			b.openedAt = b.now()
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+
+	b.notify(from, to)
+}
+
+func (b *Breaker) notify(from, to State) {
+	if from != to && b.onStateChange != nil {
+		b.onStateChange(from, to)
+	}
+}
@@ -0,0 +1,89 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type transition struct{ from, to State }
+
+func newTestBreaker(failures int) (*Breaker, *time.Time, *[]transition) {
+	now := time.Now()
+	var transitions []transition
+	b := New(Settings{
+		Failures:      failures,
+		Cooldown:      time.Second,
+		OnStateChange: func(from, to State) { transitions = append(transitions, transition{from, to}) },
+	})
+	b.now = func() time.Time { return now }
+	return b, &now, &transitions
+}
+
+func call(t *testing.T, b *Breaker, outcome Outcome) {
+	done, err := b.Allow()
+	require.NoError(t, err)
+	done(outcome)
+}
+
+func TestBreaker(t *testing.T) {
+	t.Run("Opens after consecutive failures", func(t *testing.T) {
+		b, _, transitions := newTestBreaker(3)
+
+		call(t, b, Failure)
+		call(t, b, Failure)
+		call(t, b, Success)
+		call(t, b, Failure)
+		call(t, b, Failure)
+		assert.Equal(t, Closed, b.State(), "a success resets the count")
+
+		call(t, b, Failure)
+		assert.Equal(t, Open, b.State())
+		_, err := b.Allow()
+		assert.ErrorIs(t, err, ErrOpen)
+		assert.Equal(t, []transition{{Closed, Open}}, *transitions)
+	})
+
+	t.Run("Lets a single probe through after the cooldown", func(t *testing.T) {
+		b, now, transitions := newTestBreaker(1)
+		call(t, b, Failure)
+
+		*now = now.Add(time.Second)
+		done, err := b.Allow()
+		require.NoError(t, err)
+		assert.Equal(t, HalfOpen, b.State())
+		_, err = b.Allow()
+		assert.ErrorIs(t, err, ErrOpen, "the probe is in flight")
+
+		done(Success)
+		done(Failure)
+		assert.Equal(t, Closed, b.State(), "only the first outcome counts")
+		assert.Equal(t, []transition{{Closed, Open}, {Open, HalfOpen}, {HalfOpen, Closed}}, *transitions)
+	})
+
+	t.Run("Reopens when the probe fails", func(t *testing.T) {
+		b, now, _ := newTestBreaker(1)
+		call(t, b, Failure)
+
+		*now = now.Add(time.Second)
+		call(t, b, Failure)
+		assert.Equal(t, Open, b.State())
+		_, err := b.Allow()
+		assert.ErrorIs(t, err, ErrOpen, "the cooldown restarts")
+
+		*now = now.Add(time.Second)
+		call(t, b, Ignored)
+		assert.Equal(t, HalfOpen, b.State())
+		call(t, b, Success)
+		assert.Equal(t, Closed, b.State(), "an ignored probe lets another one through")
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		b := New(Settings{})
+		assert.Equal(t, DefaultFailures, b.failures)
+		assert.Equal(t, DefaultCooldown, b.cooldown)
+		assert.Equal(t, "half_open", HalfOpen.String())
+	})
+}
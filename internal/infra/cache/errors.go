@@ -0,0 +1,28 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+var (
+	ErrNotFound         = errors.New("cache: key not found")
+	ErrConflict         = errors.New("cache: key was modified concurrently")
+	ErrNotInteger       = errors.New("cache: value is not an integer")
+	ErrTooManyConflicts = errors.New("cache: too many concurrent modifications")
+	ErrNotSupported     = errors.New("cache: operation not supported by the backend")
+	ErrUnavailable      = errors.New("cache: backend unavailable")
+)
+
+// IsUnavailable reports whether err means the backend could not be reached or did not answer in time, as opposed to
+// an answer of a healthy backend or a value that could not be used.
+func IsUnavailable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrUnavailable) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
+}
@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mayckol/rate-limiter/internal/infra/breaker"
+)
+
+// DefaultTimeout bounds the operations of a guarded client when no timeout is given.
+const DefaultTimeout = 500 * time.Millisecond
+
+// Guard returns client bounding each operation to timeout, within the deadline of its context, and refusing the
+// operations with ErrUnavailable while b is open. Scans are only bounded by their context, as they go through every
+// key.
+func Guard(client ClientInterface, b *breaker.Breaker, timeout time.Duration) ClientInterface {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return Wrap(client, func(ctx context.Context, operation string) (context.Context, func(error), error) {
+		done, err := b.Allow()
+		if err != nil {
+			return ctx, nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+
+		parent, cancel := ctx, context.CancelFunc(func() {})
+		if operation != "scan" {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		return ctx, func(err error) {
+			cancel()
+			done(outcome(parent, err))
+		}, nil
+	})
+}
+
+// outcome tells the breaker whether err, returned by an operation run with ctx, is a failure of the backend. Missing
+// keys, conflicts and values of the wrong type are answers of a healthy backend, and operations given up by their
+// caller say nothing about it.
+func outcome(ctx context.Context, err error) breaker.Outcome {
+	switch {
+	case err == nil,
+		errors.Is(err, ErrNotFound),
+		errors.Is(err, ErrConflict),
+		errors.Is(err, ErrNotInteger),
+		errors.Is(err, ErrTooManyConflicts),
+		errors.Is(err, ErrNotSupported):
+		return breaker.Success
+	case ctx.Err() != nil:
+		return breaker.Ignored
+	default:
+		return breaker.Failure
+	}
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mayckol/rate-limiter/internal/infra/breaker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubClient answers every operation with err, or blocks until its context is done when hang is set.
+type stubClient struct {
+	err   error
+	hang  bool
+	calls int
+}
+
+func (c *stubClient) answer(ctx context.Context) error {
+	c.calls++
+	if c.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return c.err
+}
+
+func (c *stubClient) Get(ctx context.Context, key string) (string, error) {
+	return "", c.answer(ctx)
+}
+
+func (c *stubClient) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return c.answer(ctx)
+}
+
+func (c *stubClient) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	return 0, c.answer(ctx)
+}
+
+func (c *stubClient) Add(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return c.answer(ctx)
+}
+
+func (c *stubClient) CompareAndSwap(ctx context.Context, key string, old string, value string, ttl time.Duration) error {
+	return c.answer(ctx)
+}
+
+func (c *stubClient) Delete(ctx context.Context, keys ...string) error {
+	return c.answer(ctx)
+}
+
+func (c *stubClient) Close() error {
+	return nil
+}
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Bounds the operations", func(t *testing.T) {
+		client := Guard(&stubClient{hang: true}, breaker.New(breaker.Settings{}), 20*time.Millisecond)
+
+		start := time.Now()
+		_, err := client.Get(ctx, "key")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("Opens on consecutive failures", func(t *testing.T) {
+		stub := &stubClient{err: errors.New("connection refused")}
+		b := breaker.New(breaker.Settings{Failures: 2, Cooldown: time.Hour})
+		client := Guard(stub, b, time.Second)
+
+		for i := 0; i < 2; i++ {
+			_, err := client.Increment(ctx, "key", 1, 0)
+			assert.Error(t, err)
+		}
+		assert.Equal(t, breaker.Open, b.State())
+
+		_, err := client.Increment(ctx, "key", 1, 0)
+		assert.ErrorIs(t, err, ErrUnavailable)
+		assert.ErrorIs(t, err, breaker.ErrOpen)
+		assert.Equal(t, 2, stub.calls, "refused without reaching the backend")
+	})
+
+	t.Run("Does not count the answers of a healthy backend", func(t *testing.T) {
+		b := breaker.New(breaker.Settings{Failures: 1})
+		for _, err := range []error{ErrNotFound, ErrConflict, ErrNotInteger} {
+			client := Guard(&stubClient{err: err}, b, time.Second)
+			_, got := client.Get(ctx, "key")
+			require.ErrorIs(t, got, err)
+		}
+		assert.Equal(t, breaker.Closed, b.State())
+	})
+
+	t.Run("Does not count the operations given up by their caller", func(t *testing.T) {
+		b := breaker.New(breaker.Settings{Failures: 1})
+		client := Guard(&stubClient{hang: true}, b, time.Second)
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := client.Get(canceled, "key")
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, breaker.Closed, b.State())
+	})
+}
@@ -1,18 +1,24 @@
+// Package cache defines the storage the rate limiter keeps its state in, independently of the backend.
 package cache
 
 import (
 	"context"
-	"github.com/go-redis/redis/v8"
 	"time"
 )
 
+// ClientInterface is implemented by every cache backend. Values are strings and a zero ttl means the key does not
+// expire. Missing keys are reported with ErrNotFound.
 type ClientInterface interface {
-	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-	Get(ctx context.Context, key string) *redis.StringCmd
-	Del(ctx context.Context, keys ...string) *redis.IntCmd
-	RPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
-	HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
-	Incr(ctx context.Context, key string) *redis.IntCmd
-	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+	// Increment adds delta to the integer stored at key and returns the new value. A missing key is created with ttl
+	// while the expiration of an existing key is left untouched.
+	Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// Add stores value only when key does not exist yet and returns ErrConflict otherwise.
+	Add(ctx context.Context, key string, value string, ttl time.Duration) error
+	// CompareAndSwap stores value only while key still holds old. It returns ErrNotFound when the key does not exist
+	// and ErrConflict when it holds another value.
+	CompareAndSwap(ctx context.Context, key string, old string, value string, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
 	Close() error
 }
@@ -1,46 +1,238 @@
+// Package memcached implements a cache backend on top of one or more memcached servers.
 package memcached
 
 import (
 	"context"
-	"github.com/go-redis/redis/v8"
+	"errors"
+	"fmt"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	defaultTimeout       = 500 * time.Millisecond
+	defaultMaxIdleConns  = 16
+	defaultMaxCASRetries = 64
+
+	// maxRelativeExpiration is the longest expiration memcached accepts in seconds, longer ones are unix timestamps.
+	maxRelativeExpiration = 30 * 24 * time.Hour
+)
+
+var (
+	_ cache.ClientInterface = (*Client)(nil)
+	_ cache.Updater         = (*Client)(nil)
+)
+
 type ClientSettings struct {
+	// Servers are the host:port addresses of the memcached servers. Keys are spread over them.
+	Servers []string
+	// Timeout bounds every network operation.
+	Timeout time.Duration
+	// MaxIdleConns is the number of idle connections kept per server.
+	MaxIdleConns int
+	// MaxCASRetries bounds how many times Update retries after losing a compare-and-swap race.
+	MaxCASRetries int
+}
+
+type Client struct {
+	mc            *memcache.Client
+	maxCASRetries int
+}
+
+func NewMemCachedClient(conf *ClientSettings) (*Client, error) {
+	if len(conf.Servers) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+
+	timeout, maxIdleConns, maxCASRetries := conf.Timeout, conf.MaxIdleConns, conf.MaxCASRetries
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	if maxCASRetries <= 0 {
+		maxCASRetries = defaultMaxCASRetries
+	}
+
+	mc := memcache.New(conf.Servers...)
+	mc.Timeout = timeout
+	mc.MaxIdleConns = maxIdleConns
+
+	if err := mc.Ping(); err != nil {
+		return nil, fmt.Errorf("memcached: %w", err)
+	}
+
+	return &Client{mc: mc, maxCASRetries: maxCASRetries}, nil
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	item, err := c.mc.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return "", cache.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(item.Value), nil
 }
 
-func NewMemCachedClient(conf *ClientSettings) (interface{}, error) {
-	return nil, nil
+func (c *Client) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return c.mc.Set(&memcache.Item{Key: key, Value: []byte(value), Expiration: seconds(ttl)})
+}
+
+// Increment adds delta to the counter stored at key, creating it when missing. Memcached only increments existing
+// keys, so a miss is followed by an add that may lose against a concurrent one, in which case the increment is retried.
+func (c *Client) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	for {
+		value, err := c.incrDecr(key, delta)
+		if err == nil {
+			return int64(value), nil
+		}
+		if !errors.Is(err, memcache.ErrCacheMiss) {
+			return 0, err
+		}
+
+		err = c.mc.Add(&memcache.Item{Key: key, Value: []byte(strconv.FormatInt(delta, 10)), Expiration: seconds(ttl)})
+		if err == nil {
+			return delta, nil
+		}
+		if !errors.Is(err, memcache.ErrNotStored) {
+			return 0, err
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
 }
 
-func (c ClientSettings) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
-	panic("implement me")
+func (c *Client) Add(ctx context.Context, key string, value string, ttl time.Duration) error {
+	err := c.mc.Add(&memcache.Item{Key: key, Value: []byte(value), Expiration: seconds(ttl)})
+	if errors.Is(err, memcache.ErrNotStored) {
+		return cache.ErrConflict
+	}
+	return err
 }
 
-func (c ClientSettings) Get(ctx context.Context, key string) *redis.StringCmd {
-	panic("implement me")
+// CompareAndSwap reads the CAS token of key with gets and stores value with cas when the key still holds old.
+func (c *Client) CompareAndSwap(ctx context.Context, key string, old string, value string, ttl time.Duration) error {
+	item, err := c.mc.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return cache.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if string(item.Value) != old {
+		return cache.ErrConflict
+	}
+
+	item.Value, item.Expiration = []byte(value), seconds(ttl)
+	return casError(c.mc.CompareAndSwap(item))
 }
 
-func (c ClientSettings) Del(ctx context.Context, keys ...string) *redis.IntCmd {
-	panic("implement me")
+func (c *Client) Delete(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := c.mc.Delete(key); err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+			return err
+		}
+	}
+	return nil
 }
 
-func (c ClientSettings) RPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
-	panic("implement me")
+// Update applies fn to the value stored at key with an optimistic gets/cas loop, or add when the key is missing.
+// When another client wins the race, fn is called again with the fresh value after a short random backoff.
+func (c *Client) Update(ctx context.Context, key string, fn cache.UpdateFunc) error {
+	for attempt := 0; attempt < c.maxCASRetries; attempt++ {
+		if attempt > 0 {
+			if err := cache.Backoff(ctx, attempt); err != nil {
+				return err
+			}
+		}
+
+		item, err := c.mc.Get(key)
+		found := err == nil
+		if err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+			return err
+		}
+
+		var current string
+		if found {
+			current = string(item.Value)
+		}
+
+		next, ttl, store := fn(current, found)
+		if !store {
+			return nil
+		}
+
+		switch {
+		case ttl <= 0 && !found:
+			return nil
+		case ttl <= 0:
+			err = c.mc.Delete(key)
+			if errors.Is(err, memcache.ErrCacheMiss) {
+				return nil
+			}
+			return err
+		case !found:
+			err = c.mc.Add(&memcache.Item{Key: key, Value: []byte(next), Expiration: seconds(cache.Expiration(ttl))})
+		default:
+			item.Value, item.Expiration = []byte(next), seconds(cache.Expiration(ttl))
+			err = c.mc.CompareAndSwap(item)
+		}
+
+		if errors.Is(err, memcache.ErrNotStored) || errors.Is(err, memcache.ErrCASConflict) ||
+			errors.Is(err, memcache.ErrCacheMiss) {
+			continue
+		}
+		return err
+	}
+	return cache.ErrTooManyConflicts
 }
 
-func (c ClientSettings) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
-	panic("implement me")
+func (c *Client) Close() error {
+	return c.mc.Close()
 }
 
-func (c ClientSettings) Incr(ctx context.Context, key string) *redis.IntCmd {
-	panic("implement me")
+// seconds converts a time to live to a memcached expiration. Memcached counts whole seconds, so the time to live is
+// rounded up, and anything longer than 30 days has to be sent as a unix timestamp.
+func seconds(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > maxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+	return int32((ttl + time.Second - 1) / time.Second)
 }
 
-func (c ClientSettings) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
-	panic("implement me")
+// incrDecr applies delta with incr or decr, memcached counters being unsigned. Decrementing stops at zero.
+func (c *Client) incrDecr(key string, delta int64) (uint64, error) {
+	var value uint64
+	var err error
+	if delta >= 0 {
+		value, err = c.mc.Increment(key, uint64(delta))
+	} else {
+		value, err = c.mc.Decrement(key, uint64(-delta))
+	}
+	if err != nil && strings.Contains(err.Error(), "non-numeric") {
+		return 0, cache.ErrNotInteger
+	}
+	return value, err
 }
 
-func (c ClientSettings) Close() error {
-	panic("implement me")
+// casError maps the errors of a cas command to the cache errors: the key was either modified or deleted meanwhile.
+func casError(err error) error {
+	switch {
+	case errors.Is(err, memcache.ErrCASConflict):
+		return cache.ErrConflict
+	case errors.Is(err, memcache.ErrNotStored), errors.Is(err, memcache.ErrCacheMiss):
+		return cache.ErrNotFound
+	default:
+		return err
+	}
 }
@@ -0,0 +1,213 @@
+package memcached
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient connects to the server in MEMCACHED_ADDR or starts a local memcached binary, skipping the test when
+// neither is available.
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+
+	addr := os.Getenv("MEMCACHED_ADDR")
+	if addr == "" {
+		addr = startServer(t)
+	}
+
+	var client *Client
+	var err error
+	for i := 0; i < 50; i++ {
+		if client, err = NewMemCachedClient(&ClientSettings{Servers: []string{addr}}); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+func startServer(t *testing.T) string {
+	t.Helper()
+
+	bin, err := exec.LookPath("memcached")
+	if err != nil {
+		t.Skip("memcached binary not found, set MEMCACHED_ADDR to run against a running server")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	cmd := exec.Command(bin, "-l", "127.0.0.1", "-p", strconv.Itoa(port), "-U", "0")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// testKey returns a key unique to the test so that runs against a shared server do not interfere.
+func testKey(t *testing.T, name string) string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "_" + t.Name() + "_" + name
+}
+
+func TestSetGetDelete(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	key := testKey(t, "key")
+
+	assert.NoError(t, client.Set(ctx, key, "10", time.Minute))
+
+	value, err := client.Get(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "10", value)
+
+	assert.NoError(t, client.Delete(ctx, key, testKey(t, "missing")))
+
+	_, err = client.Get(ctx, key)
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+}
+
+func TestIncrement(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	key := testKey(t, "counter")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Increment(ctx, key, 1, time.Second)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	value, err := client.Increment(ctx, key, -10, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(40), value)
+
+	assert.Eventually(t, func() bool {
+		_, err := client.Get(ctx, key)
+		return errors.Is(err, cache.ErrNotFound)
+	}, 3*time.Second, 100*time.Millisecond)
+
+	text := testKey(t, "text")
+	require.NoError(t, client.Set(ctx, text, "abc", time.Minute))
+	_, err = client.Increment(ctx, text, 1, 0)
+	assert.ErrorIs(t, err, cache.ErrNotInteger)
+}
+
+func TestAddCompareAndSwap(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	key := testKey(t, "key")
+
+	assert.ErrorIs(t, client.CompareAndSwap(ctx, key, "value1", "value2", time.Minute), cache.ErrNotFound)
+	assert.NoError(t, client.Add(ctx, key, "value1", time.Minute))
+	assert.ErrorIs(t, client.Add(ctx, key, "value1", time.Minute), cache.ErrConflict)
+
+	assert.ErrorIs(t, client.CompareAndSwap(ctx, key, "other", "value2", time.Minute), cache.ErrConflict)
+	assert.NoError(t, client.CompareAndSwap(ctx, key, "value1", "value2", time.Minute))
+
+	value, err := client.Get(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "value2", value)
+}
+
+func TestUpdate(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	key := testKey(t, "state")
+
+	increment := func(value string, found bool) (string, time.Duration, bool) {
+		current, _ := strconv.Atoi(value)
+		return strconv.Itoa(current + 1), time.Minute, true
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, client.Update(ctx, key, increment))
+		}()
+	}
+	wg.Wait()
+
+	value, err := client.Get(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "50", value)
+
+	err = client.Update(ctx, key, func(value string, found bool) (string, time.Duration, bool) {
+		return "", 0, true
+	})
+	assert.NoError(t, err)
+	_, err = client.Get(ctx, key)
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+}
+
+func TestLimiterStrategies(t *testing.T) {
+	client := newTestClient(t)
+
+	algorithms := []string{
+		limiter.AlgorithmFixedWindow,
+		limiter.AlgorithmSlidingLog,
+		limiter.AlgorithmSlidingWindow,
+	}
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			strategy, err := limiter.New(algorithm, client)
+			require.NoError(t, err)
+
+			key := testKey(t, "limiter")
+			limit := limiter.Limit{Rate: 10, Period: time.Minute}
+
+			var allowed atomic.Int64
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					result, err := strategy.Allow(context.Background(), key, limit)
+					if assert.NoError(t, err) && result.Allowed {
+						allowed.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			assert.Equal(t, int64(10), allowed.Load())
+		})
+	}
+}
+
+func TestSeconds(t *testing.T) {
+	assert.Equal(t, int32(0), seconds(0))
+	assert.Equal(t, int32(1), seconds(time.Millisecond))
+	assert.Equal(t, int32(2), seconds(1500*time.Millisecond))
+	assert.Equal(t, int32(60), seconds(time.Minute))
+
+	long := seconds(60 * 24 * time.Hour)
+	assert.InDelta(t, time.Now().Add(60*24*time.Hour).Unix(), int64(long), 2)
+}
@@ -0,0 +1,343 @@
+// Package memory implements an in-process cache backend for single instance deployments and tests.
+package memory
+
+import (
+	"context"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"hash/maphash"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShards          = 64
+	defaultMaxEntries      = 100_000
+	defaultCleanupInterval = time.Second
+
+	// evictionSamples is how many entries are sampled to pick the eviction victim when a shard is full.
+	evictionSamples = 5
+)
+
+var (
+	_ cache.ClientInterface = (*Client)(nil)
+	_ cache.Updater         = (*Client)(nil)
+	_ cache.Scanner         = (*Client)(nil)
+)
+
+type ClientSettings struct {
+	// Shards is the number of independently locked partitions the keys are spread over.
+	Shards int
+	// MaxEntries bounds the number of keys kept in memory. When a shard is full, expired keys are dropped first and
+	// then the key closest to expiring among a small sample.
+	MaxEntries int
+	// CleanupInterval is how often expired keys are removed in the background.
+	CleanupInterval time.Duration
+	// Now returns the current time. It defaults to time.Now and lets tests control expiration.
+	Now func() time.Time
+}
+
+type Client struct {
+	shards []*shard
+	seed   maphash.Seed
+	now    func() time.Time
+	stop   chan struct{}
+	once   sync.Once
+}
+
+type shard struct {
+	mu         sync.Mutex
+	entries    map[string]*entry
+	maxEntries int
+}
+
+type entry struct {
+	value     string
+	expiresAt time.Time
+}
+
+func NewMemoryClient(conf *ClientSettings) (*Client, error) {
+	shards, maxEntries, interval, now := conf.Shards, conf.MaxEntries, conf.CleanupInterval, conf.Now
+	if shards <= 0 {
+		shards = defaultShards
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxEntries
+	}
+	if interval <= 0 {
+		interval = defaultCleanupInterval
+	}
+	if now == nil {
+		now = time.Now
+	}
+
+	perShard := maxEntries / shards
+	if perShard < 1 {
+		perShard = 1
+	}
+
+	c := &Client{
+		shards: make([]*shard, shards),
+		seed:   maphash.MakeSeed(),
+		now:    now,
+		stop:   make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard{entries: make(map[string]*entry), maxEntries: perShard}
+	}
+
+	go c.janitor(interval)
+
+	return c, nil
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.get(key, c.now())
+	if e == nil {
+		return "", cache.ErrNotFound
+	}
+	return e.value, nil
+}
+
+func (c *Client) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.put(key, &entry{value: value, expiresAt: c.expiresAt(ttl)}, c.now())
+	return nil
+}
+
+func (c *Client) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := c.now()
+	e := s.get(key, now)
+	if e == nil {
+		s.put(key, &entry{value: strconv.FormatInt(delta, 10), expiresAt: c.expiresAt(ttl)}, now)
+		return delta, nil
+	}
+
+	current, err := strconv.ParseInt(e.value, 10, 64)
+	if err != nil {
+		return 0, cache.ErrNotInteger
+	}
+
+	current += delta
+	e.value = strconv.FormatInt(current, 10)
+	return current, nil
+}
+
+func (c *Client) Add(ctx context.Context, key string, value string, ttl time.Duration) error {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := c.now()
+	if s.get(key, now) != nil {
+		return cache.ErrConflict
+	}
+
+	s.put(key, &entry{value: value, expiresAt: c.expiresAt(ttl)}, now)
+	return nil
+}
+
+func (c *Client) CompareAndSwap(ctx context.Context, key string, old string, value string, ttl time.Duration) error {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := c.now()
+	e := s.get(key, now)
+	if e == nil {
+		return cache.ErrNotFound
+	}
+	if e.value != old {
+		return cache.ErrConflict
+	}
+
+	s.put(key, &entry{value: value, expiresAt: c.expiresAt(ttl)}, now)
+	return nil
+}
+
+func (c *Client) Delete(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		s := c.shard(key)
+		s.mu.Lock()
+		delete(s.entries, key)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Update applies fn to the string stored at key while holding the lock of its shard.
+func (c *Client) Update(ctx context.Context, key string, fn cache.UpdateFunc) error {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := c.now()
+	var current string
+	e := s.get(key, now)
+	if e != nil {
+		current = e.value
+	}
+
+	next, ttl, store := fn(current, e != nil)
+	if !store {
+		return nil
+	}
+	if ttl <= 0 {
+		delete(s.entries, key)
+		return nil
+	}
+
+	s.put(key, &entry{value: next, expiresAt: c.expiresAt(cache.Expiration(ttl))}, now)
+	return nil
+}
+
+// Scan iterates over the keys of every shard. The keys of a shard are collected under its lock and fn is called after
+// releasing it.
+func (c *Client) Scan(ctx context.Context, pattern string, fn func(key string) error) error {
+	for _, s := range c.shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var keys []string
+		s.mu.Lock()
+		now := c.now()
+		for key, e := range s.entries {
+			if !e.expired(now) && cache.Match(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops the background cleanup. The stored keys stay readable.
+func (c *Client) Close() error {
+	c.once.Do(func() { close(c.stop) })
+	return nil
+}
+
+// Len returns the number of keys currently stored, including expired keys not cleaned up yet.
+func (c *Client) Len() int {
+	total := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		total += len(s.entries)
+		s.mu.Unlock()
+	}
+	return total
+}
+
+func (c *Client) shard(key string) *shard {
+	return c.shards[maphash.String(c.seed, key)%uint64(len(c.shards))]
+}
+
+func (c *Client) expiresAt(expiration time.Duration) time.Time {
+	if expiration <= 0 {
+		return time.Time{}
+	}
+	return c.now().Add(expiration)
+}
+
+func (c *Client) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.deleteExpired()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *Client) deleteExpired() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		now := c.now()
+		for key, e := range s.entries {
+			if e.expired(now) {
+				delete(s.entries, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// get returns the live entry stored at key, dropping it when it has expired. The shard lock must be held.
+func (s *shard) get(key string, now time.Time) *entry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if e.expired(now) {
+		delete(s.entries, key)
+		return nil
+	}
+	return e
+}
+
+// put stores e at key, evicting another key first when the shard is full. The shard lock must be held.
+func (s *shard) put(key string, e *entry, now time.Time) {
+	if _, exists := s.entries[key]; !exists && len(s.entries) >= s.maxEntries {
+		s.evict(now)
+	}
+	s.entries[key] = e
+}
+
+// evict removes one key from a random sample, preferring expired keys and then the one closest to expiring.
+func (s *shard) evict(now time.Time) {
+	var victim string
+	var victimEntry *entry
+	sampled := 0
+
+	for key, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, key)
+			return
+		}
+		if victimEntry == nil || e.expiresBefore(victimEntry) {
+			victim, victimEntry = key, e
+		}
+		sampled++
+		if sampled == evictionSamples {
+			break
+		}
+	}
+
+	if victimEntry != nil {
+		delete(s.entries, victim)
+	}
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// expiresBefore reports whether e expires before other, keys without expiration being the last ones.
+func (e *entry) expiresBefore(other *entry) bool {
+	if e.expiresAt.IsZero() {
+		return false
+	}
+	return other.expiresAt.IsZero() || e.expiresAt.Before(other.expiresAt)
+}
@@ -0,0 +1,231 @@
+package memory
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testClock struct {
+	mu      sync.Mutex
+	current time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = c.current.Add(d)
+}
+
+func newTestClient(t *testing.T, settings *ClientSettings) (*Client, *testClock) {
+	clock := &testClock{current: time.Unix(1_700_000_000, 0)}
+	settings.Now = clock.Now
+
+	client, err := NewMemoryClient(settings)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client, clock
+}
+
+func TestSetGet(t *testing.T) {
+	client, _ := newTestClient(t, &ClientSettings{})
+	ctx := context.Background()
+
+	assert.NoError(t, client.Set(ctx, "key1", "10", 0))
+
+	value, err := client.Get(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "10", value)
+
+	_, err = client.Get(ctx, "missing")
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+
+	assert.NoError(t, client.Delete(ctx, "key1", "missing"))
+	_, err = client.Get(ctx, "key1")
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+}
+
+func TestExpiration(t *testing.T) {
+	client, clock := newTestClient(t, &ClientSettings{})
+	ctx := context.Background()
+
+	require.NoError(t, client.Set(ctx, "key1", "value1", time.Second))
+	require.NoError(t, client.Set(ctx, "key2", "value2", 0))
+
+	clock.Advance(999 * time.Millisecond)
+	value, err := client.Get(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "value1", value)
+
+	clock.Advance(time.Millisecond)
+	_, err = client.Get(ctx, "key1")
+	assert.ErrorIs(t, err, cache.ErrNotFound)
+	value, err = client.Get(ctx, "key2")
+	assert.NoError(t, err)
+	assert.Equal(t, "value2", value)
+}
+
+func TestIncrement(t *testing.T) {
+	client, clock := newTestClient(t, &ClientSettings{})
+	ctx := context.Background()
+
+	value, err := client.Increment(ctx, "counter", 1, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+
+	clock.Advance(500 * time.Millisecond)
+	value, err = client.Increment(ctx, "counter", 2, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+
+	clock.Advance(500 * time.Millisecond)
+	value, err = client.Increment(ctx, "counter", 1, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+
+	require.NoError(t, client.Set(ctx, "text", "abc", 0))
+	_, err = client.Increment(ctx, "text", 1, 0)
+	assert.ErrorIs(t, err, cache.ErrNotInteger)
+}
+
+func TestAddCompareAndSwap(t *testing.T) {
+	client, _ := newTestClient(t, &ClientSettings{})
+	ctx := context.Background()
+
+	assert.ErrorIs(t, client.CompareAndSwap(ctx, "key1", "value1", "value2", 0), cache.ErrNotFound)
+	assert.NoError(t, client.Add(ctx, "key1", "value1", 0))
+	assert.ErrorIs(t, client.Add(ctx, "key1", "value1", 0), cache.ErrConflict)
+
+	assert.ErrorIs(t, client.CompareAndSwap(ctx, "key1", "other", "value2", 0), cache.ErrConflict)
+	assert.NoError(t, client.CompareAndSwap(ctx, "key1", "value1", "value2", 0))
+
+	value, err := client.Get(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "value2", value)
+}
+
+func TestBackgroundCleanup(t *testing.T) {
+	client, clock := newTestClient(t, &ClientSettings{CleanupInterval: 10 * time.Millisecond})
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		client.Set(ctx, "key"+strconv.Itoa(i), strconv.Itoa(i), time.Second)
+	}
+	assert.Equal(t, 100, client.Len())
+
+	clock.Advance(time.Second)
+	assert.Eventually(t, func() bool { return client.Len() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestBoundedEntries(t *testing.T) {
+	client, _ := newTestClient(t, &ClientSettings{Shards: 4, MaxEntries: 40})
+	ctx := context.Background()
+
+	for i := 0; i < 1000; i++ {
+		client.Set(ctx, "key"+strconv.Itoa(i), strconv.Itoa(i), time.Duration(i+1)*time.Second)
+	}
+
+	assert.LessOrEqual(t, client.Len(), 40)
+	value, err := client.Get(ctx, "key999")
+	assert.NoError(t, err)
+	assert.Equal(t, "999", value)
+}
+
+func TestUpdate(t *testing.T) {
+	t.Run("Applies updates atomically", func(t *testing.T) {
+		client, _ := newTestClient(t, &ClientSettings{})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 500; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := client.Update(context.Background(), "counter", func(value string, found bool) (string, time.Duration, bool) {
+					current, _ := strconv.Atoi(value)
+					return strconv.Itoa(current + 1), time.Minute, true
+				})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		value, err := client.Get(context.Background(), "counter")
+		assert.NoError(t, err)
+		assert.Equal(t, "500", value)
+	})
+
+	t.Run("Leaves the key untouched when not storing", func(t *testing.T) {
+		client, clock := newTestClient(t, &ClientSettings{})
+		ctx := context.Background()
+
+		client.Set(ctx, "key1", "value1", time.Second)
+		err := client.Update(ctx, "key1", func(value string, found bool) (string, time.Duration, bool) {
+			assert.True(t, found)
+			assert.Equal(t, "value1", value)
+			return "value2", time.Hour, false
+		})
+		assert.NoError(t, err)
+
+		clock.Advance(time.Second)
+		err = client.Update(ctx, "key1", func(value string, found bool) (string, time.Duration, bool) {
+			assert.False(t, found)
+			return "", 0, false
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Keeps the values stored without expiration", func(t *testing.T) {
+		client, clock := newTestClient(t, &ClientSettings{})
+		ctx := context.Background()
+
+		err := client.Update(ctx, "key1", func(value string, found bool) (string, time.Duration, bool) {
+			return "value1", cache.NoExpiration, true
+		})
+		require.NoError(t, err)
+
+		clock.Advance(24 * time.Hour)
+		value, err := client.Get(ctx, "key1")
+		assert.NoError(t, err)
+		assert.Equal(t, "value1", value)
+	})
+}
+
+func TestScan(t *testing.T) {
+	client, clock := newTestClient(t, &ClientSettings{})
+	ctx := context.Background()
+
+	require.NoError(t, client.Set(ctx, "rate_limiter_2001:db8::/64:ban", "1", 0))
+	require.NoError(t, client.Set(ctx, "rate_limiter_10.0.0.1:ban", "1", time.Second))
+	require.NoError(t, client.Set(ctx, "rate_limiter_10.0.0.1:offenses", "1", 0))
+
+	scan := func(pattern string) []string {
+		var keys []string
+		require.NoError(t, client.Scan(ctx, pattern, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		}))
+		return keys
+	}
+	assert.ElementsMatch(t, []string{"rate_limiter_2001:db8::/64:ban", "rate_limiter_10.0.0.1:ban"}, scan("*:ban"))
+	assert.Equal(t, []string{"rate_limiter_10.0.0.1:offenses"}, scan("rate_limiter_10.0.0.?:*s"))
+
+	clock.Advance(time.Second)
+	assert.Equal(t, []string{"rate_limiter_2001:db8::/64:ban"}, scan("*:ban"), "expired keys are skipped")
+	assert.Empty(t, scan("ban"))
+
+	err := client.Scan(ctx, "*", func(key string) error { return assert.AnError })
+	assert.ErrorIs(t, err, assert.AnError)
+}
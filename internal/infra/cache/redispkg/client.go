@@ -3,39 +3,190 @@ package redispkg
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"strings"
+	"time"
 )
 
+var (
+	_ cache.ClientInterface = (*Client)(nil)
+	_ cache.Scripter        = (*Client)(nil)
+	_ cache.Scanner         = (*Client)(nil)
+)
+
+// incrementScript increments KEYS[1] by ARGV[1] and sets the ARGV[2] milliseconds expiration when the key has none,
+// which is the case of a key the increment just created.
+var incrementScript = cache.NewScript(`
+local value = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) == -1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return value
+`)
+
+// compareAndSwapScript replaces KEYS[1] with ARGV[2] when it holds ARGV[1], expiring it after ARGV[3] milliseconds
+// unless that is zero. It returns 1 on success, 0 when the key does not exist and -1 when it holds another value.
+var compareAndSwapScript = cache.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+	return 0
+end
+if current ~= ARGV[1] then
+	return -1
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
 type ClientSettings struct {
 	Host     string
 	Port     string
 	Password string
 	AppEnv   string
+	// MaxRetries is how many times a failed command is retried. Zero disables the retries, which would only multiply
+	// the latency of a slow server.
+	MaxRetries int
+}
+
+// Client implements the cache on top of Redis. Scripts are run with EVALSHA and only sent again with EVAL when the
+// server does not have them cached.
+type Client struct {
+	rdb *redis.Client
 }
 
-func NewRedisClient(conf *ClientSettings) (*redis.Client, error) {
+func NewRedisClient(conf *ClientSettings) (*Client, error) {
 	host, port, password := conf.Host, conf.Port, conf.Password
 
 	if host == "" || port == "" {
 		return nil, fmt.Errorf("redis configuration error: REDIS_HOST or REDIS_PORT is not set")
 	}
 
+	maxRetries := conf.MaxRetries
+	if maxRetries == 0 {
+		// go-redis retries 3 times on zero.
+		maxRetries = -1
+	}
 	opts := &redis.Options{
 		Addr:       fmt.Sprintf("%s:%s", host, port),
 		Password:   password,
-		MaxRetries: 3,
+		MaxRetries: maxRetries,
 	}
 
 	if conf.AppEnv != "local" && password != "" {
 		opts.TLSConfig = &tls.Config{InsecureSkipVerify: false}
 	}
 
-	client := redis.NewClient(opts)
+	rdb := redis.NewClient(opts)
 
-	if _, err := client.Ping(context.Background()).Result(); err != nil {
+	if _, err := rdb.Ping(context.Background()).Result(); err != nil {
 		return nil, fmt.Errorf("failed to connect to redis: %v", err)
 	}
 
-	return client, nil
+	return NewClient(rdb), nil
+}
+
+// NewClient wraps an already configured go-redis client.
+func NewClient(rdb *redis.Client) *Client {
+	return &Client{rdb: rdb}
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	value, err := c.rdb.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", cache.ErrNotFound
+	}
+	return value, err
+}
+
+func (c *Client) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return c.rdb.Set(ctx, key, value, max(ttl, 0)).Err()
+}
+
+func (c *Client) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	reply, err := c.RunScript(ctx, incrementScript, []string{key}, delta, max(ttl, 0).Milliseconds())
+	if err != nil {
+		if strings.Contains(err.Error(), "not an integer") {
+			return 0, cache.ErrNotInteger
+		}
+		return 0, err
+	}
+
+	value, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected increment reply: %v", reply)
+	}
+	return value, nil
+}
+
+func (c *Client) Add(ctx context.Context, key string, value string, ttl time.Duration) error {
+	stored, err := c.rdb.SetNX(ctx, key, value, max(ttl, 0)).Result()
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return cache.ErrConflict
+	}
+	return nil
+}
+
+func (c *Client) CompareAndSwap(ctx context.Context, key string, old string, value string, ttl time.Duration) error {
+	reply, err := c.RunScript(ctx, compareAndSwapScript, []string{key}, old, value, max(ttl, 0).Milliseconds())
+	if err != nil {
+		return err
+	}
+
+	switch reply {
+	case int64(1):
+		return nil
+	case int64(0):
+		return cache.ErrNotFound
+	default:
+		return cache.ErrConflict
+	}
+}
+
+func (c *Client) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.rdb.Del(ctx, keys...).Err()
+}
+
+// RunScript runs the script with EVALSHA and falls back to EVAL when the server replies NOSCRIPT, which also caches it
+// for the next calls.
+func (c *Client) RunScript(ctx context.Context, script *cache.Script, keys []string, args ...interface{}) (interface{}, error) {
+	reply, err := c.rdb.EvalSha(ctx, script.Hash(), keys, args...).Result()
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		reply, err = c.rdb.Eval(ctx, script.Source(), keys, args...).Result()
+	}
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return reply, err
+}
+
+// scanCount is the number of keys SCAN is hinted to inspect per call.
+const scanCount = 100
+
+// Scan walks the keyspace with SCAN, which does not block the server like KEYS does. A key may be reported more than
+// once if the keyspace is resized during the scan.
+func (c *Client) Scan(ctx context.Context, pattern string, fn func(key string) error) error {
+	iter := c.rdb.Scan(ctx, 0, pattern, scanCount).Iterator()
+	for iter.Next(ctx) {
+		if err := fn(iter.Val()); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (c *Client) Close() error {
+	return c.rdb.Close()
 }
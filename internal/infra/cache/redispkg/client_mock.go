@@ -2,7 +2,7 @@ package redispkg
 
 import (
 	"context"
-	"github.com/go-redis/redis/v8"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
 	"github.com/stretchr/testify/mock"
 	"time"
 )
@@ -11,42 +11,42 @@ type MockRedisClient struct {
 	mock.Mock
 }
 
-func (m *MockRedisClient) Incr(ctx context.Context, key string) *redis.IntCmd {
+func (m *MockRedisClient) Get(ctx context.Context, key string) (string, error) {
 	args := m.Called(ctx, key)
-	return args.Get(0).(*redis.IntCmd)
+	return args.String(0), args.Error(1)
 }
 
-func (m *MockRedisClient) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
-	args := m.Called(ctx, key, expiration)
-	return args.Get(0).(*redis.BoolCmd)
+func (m *MockRedisClient) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	args := m.Called(ctx, key, value, ttl)
+	return args.Error(0)
 }
 
-func (m *MockRedisClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
-	args := m.Called(ctx, key, value, expiration)
-	return args.Get(0).(*redis.StatusCmd)
+func (m *MockRedisClient) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	args := m.Called(ctx, key, delta, ttl)
+	return args.Get(0).(int64), args.Error(1)
 }
 
-func (m *MockRedisClient) Get(ctx context.Context, key string) *redis.StringCmd {
-	args := m.Called(ctx, key)
-	return args.Get(0).(*redis.StringCmd)
+func (m *MockRedisClient) Add(ctx context.Context, key string, value string, ttl time.Duration) error {
+	args := m.Called(ctx, key, value, ttl)
+	return args.Error(0)
 }
 
-func (m *MockRedisClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
-	args := m.Called(ctx, keys)
-	return args.Get(0).(*redis.IntCmd)
+func (m *MockRedisClient) CompareAndSwap(ctx context.Context, key string, old string, value string, ttl time.Duration) error {
+	args := m.Called(ctx, key, old, value, ttl)
+	return args.Error(0)
 }
 
-func (m *MockRedisClient) Close() error {
-	args := m.Called()
+func (m *MockRedisClient) Delete(ctx context.Context, keys ...string) error {
+	args := m.Called(ctx, keys)
 	return args.Error(0)
 }
 
-func (m *MockRedisClient) RPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
-	args := m.Called(ctx, key, values)
-	return args.Get(0).(*redis.IntCmd)
+func (m *MockRedisClient) RunScript(ctx context.Context, script *cache.Script, keys []string, args ...interface{}) (interface{}, error) {
+	callArgs := m.Called(ctx, script, keys, args)
+	return callArgs.Get(0), callArgs.Error(1)
 }
 
-func (m *MockRedisClient) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
-	args := m.Called(ctx, key, values)
-	return args.Get(0).(*redis.IntCmd)
+func (m *MockRedisClient) Close() error {
+	args := m.Called()
+	return args.Error(0)
 }
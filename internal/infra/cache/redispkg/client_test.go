@@ -2,72 +2,44 @@ package redispkg
 
 import (
 	"context"
-	"github.com/go-redis/redis/v8"
-	"github.com/stretchr/testify/mock"
 	"testing"
 	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
+func newTestClient(t *testing.T) (*Client, *miniredis.Miniredis) {
+	srv := miniredis.RunT(t)
+	client := NewClient(redis.NewClient(&redis.Options{Addr: srv.Addr()}))
+	t.Cleanup(func() { _ = client.Close() })
+	return client, srv
+}
+
 func TestSet(t *testing.T) {
 	mockRedis := new(MockRedisClient)
-	mockRedis.On("Set", mock.Anything, "key1", "value1", 10*time.Minute).Return(redis.NewStatusResult("OK", nil))
+	mockRedis.On("Set", mock.Anything, "key1", "value1", 10*time.Minute).Return(nil)
 	mockRedis.Set(context.Background(), "key1", "value1", 10*time.Minute)
 	mockRedis.AssertExpectations(t)
 }
 
 func TestGet(t *testing.T) {
 	mockRedis := new(MockRedisClient)
-	mockRedis.On("Get", mock.Anything, "key1").Return(redis.NewStringResult("value1", nil))
+	mockRedis.On("Get", mock.Anything, "key1").Return("value1", nil)
 	mockRedis.Get(context.Background(), "key1")
 	mockRedis.AssertExpectations(t)
 }
 
-func TestDel(t *testing.T) {
-	mockRedis := new(MockRedisClient)
-
-	cmd := redis.NewIntCmd(context.Background(), "DEL", "key1")
-	cmd.SetVal(1)
-
-	mockRedis.On("Del", mock.Anything, []string{"key1"}).Return(cmd)
-
-	result := mockRedis.Del(context.Background(), "key1")
-
-	if result.Val() != 1 {
-		t.Errorf("Expected 1, got %d", result.Val())
-	}
-
-	mockRedis.AssertExpectations(t)
-}
-
-func TestRPush(t *testing.T) {
-	mockRedis := new(MockRedisClient)
-
-	cmd := redis.NewIntCmd(context.Background(), "RPUSH", "key1", "value1")
-	cmd.SetVal(1)
-
-	mockRedis.On("RPush", mock.Anything, "key1", []interface{}{"value1"}).Return(cmd)
-
-	result := mockRedis.RPush(context.Background(), "key1", "value1")
-
-	if result.Val() != 1 {
-		t.Errorf("Expected 1, got %d", result.Val())
-	}
-
-	mockRedis.AssertExpectations(t)
-}
-
-func TestHSet(t *testing.T) {
+func TestDelete(t *testing.T) {
 	mockRedis := new(MockRedisClient)
+	mockRedis.On("Delete", mock.Anything, []string{"key1"}).Return(nil)
 
-	cmd := redis.NewIntCmd(context.Background(), "HSET", "key1", "field1", "value1")
-	cmd.SetVal(1)
-
-	mockRedis.On("HSet", mock.Anything, "key1", []interface{}{"field1", "value1"}).Return(cmd)
-
-	result := mockRedis.HSet(context.Background(), "key1", "field1", "value1")
-
-	if result.Val() != 1 {
-		t.Errorf("Expected 1, got %d", result.Val())
+	if err := mockRedis.Delete(context.Background(), "key1"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
 	}
 
 	mockRedis.AssertExpectations(t)
@@ -79,3 +51,102 @@ func TestClose(t *testing.T) {
 	mockRedis.Close()
 	mockRedis.AssertExpectations(t)
 }
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Gets and sets values", func(t *testing.T) {
+		client, srv := newTestClient(t)
+
+		assert.NoError(t, client.Set(ctx, "key1", "value1", time.Second))
+		value, err := client.Get(ctx, "key1")
+		assert.NoError(t, err)
+		assert.Equal(t, "value1", value)
+
+		srv.FastForward(time.Second)
+		_, err = client.Get(ctx, "key1")
+		assert.ErrorIs(t, err, cache.ErrNotFound)
+	})
+
+	t.Run("Increments with an expiration on creation", func(t *testing.T) {
+		client, srv := newTestClient(t)
+
+		value, err := client.Increment(ctx, "counter", 1, time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), value)
+
+		srv.FastForward(500 * time.Millisecond)
+		value, err = client.Increment(ctx, "counter", 2, time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), value)
+		assert.Equal(t, 500*time.Millisecond, srv.TTL("counter"))
+
+		require.NoError(t, client.Set(ctx, "text", "abc", 0))
+		_, err = client.Increment(ctx, "text", 1, 0)
+		assert.ErrorIs(t, err, cache.ErrNotInteger)
+	})
+
+	t.Run("Adds missing keys only", func(t *testing.T) {
+		client, _ := newTestClient(t)
+
+		assert.NoError(t, client.Add(ctx, "key1", "value1", time.Second))
+		assert.ErrorIs(t, client.Add(ctx, "key1", "value2", time.Second), cache.ErrConflict)
+	})
+
+	t.Run("Compares and swaps", func(t *testing.T) {
+		client, srv := newTestClient(t)
+
+		assert.ErrorIs(t, client.CompareAndSwap(ctx, "key1", "value1", "value2", time.Second), cache.ErrNotFound)
+
+		require.NoError(t, client.Set(ctx, "key1", "value1", 0))
+		assert.ErrorIs(t, client.CompareAndSwap(ctx, "key1", "other", "value2", time.Second), cache.ErrConflict)
+		assert.NoError(t, client.CompareAndSwap(ctx, "key1", "value1", "value2", time.Second))
+
+		value, err := client.Get(ctx, "key1")
+		assert.NoError(t, err)
+		assert.Equal(t, "value2", value)
+		assert.Equal(t, time.Second, srv.TTL("key1"))
+	})
+
+	t.Run("Deletes keys", func(t *testing.T) {
+		client, _ := newTestClient(t)
+
+		require.NoError(t, client.Set(ctx, "key1", "value1", 0))
+		assert.NoError(t, client.Delete(ctx, "key1", "missing"))
+		_, err := client.Get(ctx, "key1")
+		assert.ErrorIs(t, err, cache.ErrNotFound)
+	})
+
+	t.Run("Runs scripts after the script cache is flushed", func(t *testing.T) {
+		client, _ := newTestClient(t)
+		script := cache.NewScript(`return tonumber(ARGV[1]) + 1`)
+
+		reply, err := client.RunScript(ctx, script, nil, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), reply)
+
+		assert.NoError(t, client.rdb.ScriptFlush(ctx).Err())
+
+		reply, err = client.RunScript(ctx, script, nil, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), reply)
+	})
+
+	t.Run("Scans the keys matching a pattern", func(t *testing.T) {
+		client, _ := newTestClient(t)
+		for _, key := range []string{"a:ban", "b:ban", "a:offenses", "c"} {
+			require.NoError(t, client.Set(ctx, key, "1", 0))
+		}
+
+		var keys []string
+		err := client.Scan(ctx, "*:ban", func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a:ban", "b:ban"}, keys)
+
+		err = client.Scan(ctx, "*", func(key string) error { return assert.AnError })
+		assert.ErrorIs(t, err, assert.AnError)
+	})
+}
@@ -0,0 +1,37 @@
+package cache
+
+import "context"
+
+// Scanner is implemented by backends that can list their keys, such as Redis and the in-memory cache. Memcached cannot.
+type Scanner interface {
+	// Scan calls fn with every live key matching pattern, stopping at the first error fn returns. Keys written during
+	// the scan may or may not be reported.
+	Scan(ctx context.Context, pattern string, fn func(key string) error) error
+}
+
+// Match reports whether key matches pattern, where * matches any sequence of characters and ? any single one, the
+// subset of the Redis glob syntax every Scanner supports.
+func Match(pattern, key string) bool {
+	p, k := 0, 0
+	star, next := -1, 0
+	for k < len(key) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == key[k]):
+			p++
+			k++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, k
+			p++
+		case star >= 0:
+			// Let the last star absorb one more character and retry from there.
+			next++
+			p, k = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
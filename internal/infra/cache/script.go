@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// Script is a Lua script run atomically by backends implementing Scripter.
+type Script struct {
+	src  string
+	hash string
+}
+
+func NewScript(src string) *Script {
+	sum := sha1.Sum([]byte(src))
+	return &Script{src: src, hash: hex.EncodeToString(sum[:])}
+}
+
+// Source returns the Lua source of the script.
+func (s *Script) Source() string {
+	return s.src
+}
+
+// Hash returns the SHA1 digest the server caches the script under.
+func (s *Script) Hash() string {
+	return s.hash
+}
+
+// Scripter is the transaction hook of backends that can run a script atomically on the server. The reply is converted
+// like Redis does: integers as int64, strings as string, arrays as []interface{} and nil for a missing value.
+type Scripter interface {
+	RunScript(ctx context.Context, script *Script, keys []string, args ...interface{}) (interface{}, error)
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// maxUpdateAttempts bounds how many times Update retries after losing a race against another client.
+const maxUpdateAttempts = 64
+
+// NoExpiration is the ttl an UpdateFunc returns to store a value that does not expire.
+const NoExpiration = time.Duration(math.MaxInt64)
+
+// UpdateFunc receives the current value of a key, with found false when the key does not exist, and returns the value
+// to store along with its time to live. Returning store false leaves the key untouched, a ttl of zero or less deletes
+// it and NoExpiration keeps it until it is deleted.
+type UpdateFunc func(value string, found bool) (next string, ttl time.Duration, store bool)
+
+// Expiration returns the ttl to give the operations of ClientInterface for the ttl returned by an UpdateFunc.
+func Expiration(ttl time.Duration) time.Duration {
+	if ttl == NoExpiration {
+		return 0
+	}
+	return ttl
+}
+
+// Updater is implemented by backends that can apply a read-modify-write to a single key atomically on their own, for
+// instance under a lock. The function may be called more than once if the backend retries.
+type Updater interface {
+	Update(ctx context.Context, key string, fn UpdateFunc) error
+}
+
+// Update applies fn to the value stored at key atomically. It uses the Updater of the backend when there is one and an
+// optimistic loop of Get followed by Add or CompareAndSwap otherwise, calling fn again whenever another client modified
+// the key in between.
+func Update(ctx context.Context, client ClientInterface, key string, fn UpdateFunc) error {
+	if u, ok := client.(Updater); ok {
+		return u.Update(ctx, key, fn)
+	}
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		if attempt > 0 {
+			if err := Backoff(ctx, attempt); err != nil {
+				return err
+			}
+		}
+
+		current, err := client.Get(ctx, key)
+		found := err == nil
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		next, ttl, store := fn(current, found)
+		switch {
+		case !store, ttl <= 0 && !found:
+			return nil
+		case ttl <= 0:
+			// The key is deleted without checking it still holds current, the state a strategy drops is stale anyway.
+			return client.Delete(ctx, key)
+		case found:
+			err = client.CompareAndSwap(ctx, key, current, next, Expiration(ttl))
+		default:
+			err = client.Add(ctx, key, next, Expiration(ttl))
+		}
+
+		if errors.Is(err, ErrConflict) || errors.Is(err, ErrNotFound) {
+			continue
+		}
+		return err
+	}
+	return ErrTooManyConflicts
+}
+
+// Backoff waits a random duration that grows with the attempt, up to 10ms, so that clients competing for the same key
+// spread out. It returns early with the context error when ctx is done.
+func Backoff(ctx context.Context, attempt int) error {
+	limit := time.Duration(min(max(attempt, 1), 10)) * time.Millisecond
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(limit))))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
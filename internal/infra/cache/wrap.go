@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Hook is called before every operation of a wrapped client, named get, set, increment, add, compare_and_swap, delete,
+// run_script, update or scan. The operation runs with the returned context, and done is called with its error once it
+// returns. When the hook returns an error instead, the operation is not run and fails with it.
+type Hook func(ctx context.Context, operation string) (_ context.Context, done func(err error), err error)
+
+// Wrap returns client calling hook around its operations. The result implements the same optional interfaces as
+// client among Scripter, Updater and Scanner, so that the strategies keep choosing the same path.
+func Wrap(client ClientInterface, hook Hook) ClientInterface {
+	c := &wrapped{client: client, hook: hook}
+	scripter, isScripter := client.(Scripter)
+	updater, isUpdater := client.(Updater)
+	scanner, isScanner := client.(Scanner)
+	s := &wrappedScripter{scripter: scripter, hook: hook}
+	u := &wrappedUpdater{updater: updater, hook: hook}
+	sc := &wrappedScanner{scanner: scanner, hook: hook}
+
+	switch {
+	case isScripter && isUpdater && isScanner:
+		return struct {
+			*wrapped
+			*wrappedScripter
+			*wrappedUpdater
+			*wrappedScanner
+		}{c, s, u, sc}
+	case isScripter && isUpdater:
+		return struct {
+			*wrapped
+			*wrappedScripter
+			*wrappedUpdater
+		}{c, s, u}
+	case isScripter && isScanner:
+		return struct {
+			*wrapped
+			*wrappedScripter
+			*wrappedScanner
+		}{c, s, sc}
+	case isUpdater && isScanner:
+		return struct {
+			*wrapped
+			*wrappedUpdater
+			*wrappedScanner
+		}{c, u, sc}
+	case isScripter:
+		return struct {
+			*wrapped
+			*wrappedScripter
+		}{c, s}
+	case isUpdater:
+		return struct {
+			*wrapped
+			*wrappedUpdater
+		}{c, u}
+	case isScanner:
+		return struct {
+			*wrapped
+			*wrappedScanner
+		}{c, sc}
+	default:
+		return c
+	}
+}
+
+type wrapped struct {
+	client ClientInterface
+	hook   Hook
+}
+
+func (c *wrapped) Get(ctx context.Context, key string) (_ string, err error) {
+	ctx, done, err := c.hook(ctx, "get")
+	if err != nil {
+		return "", err
+	}
+	defer func() { done(err) }()
+	return c.client.Get(ctx, key)
+}
+
+func (c *wrapped) Set(ctx context.Context, key string, value string, ttl time.Duration) (err error) {
+	ctx, done, err := c.hook(ctx, "set")
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return c.client.Set(ctx, key, value, ttl)
+}
+
+func (c *wrapped) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (_ int64, err error) {
+	ctx, done, err := c.hook(ctx, "increment")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { done(err) }()
+	return c.client.Increment(ctx, key, delta, ttl)
+}
+
+func (c *wrapped) Add(ctx context.Context, key string, value string, ttl time.Duration) (err error) {
+	ctx, done, err := c.hook(ctx, "add")
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return c.client.Add(ctx, key, value, ttl)
+}
+
+func (c *wrapped) CompareAndSwap(ctx context.Context, key string, old string, value string, ttl time.Duration) (err error) {
+	ctx, done, err := c.hook(ctx, "compare_and_swap")
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return c.client.CompareAndSwap(ctx, key, old, value, ttl)
+}
+
+func (c *wrapped) Delete(ctx context.Context, keys ...string) (err error) {
+	ctx, done, err := c.hook(ctx, "delete")
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return c.client.Delete(ctx, keys...)
+}
+
+func (c *wrapped) Close() error {
+	return c.client.Close()
+}
+
+type wrappedScripter struct {
+	scripter Scripter
+	hook     Hook
+}
+
+func (s *wrappedScripter) RunScript(ctx context.Context, script *Script, keys []string, args ...interface{}) (_ interface{}, err error) {
+	ctx, done, err := s.hook(ctx, "run_script")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { done(err) }()
+	return s.scripter.RunScript(ctx, script, keys, args...)
+}
+
+type wrappedUpdater struct {
+	updater Updater
+	hook    Hook
+}
+
+func (u *wrappedUpdater) Update(ctx context.Context, key string, fn UpdateFunc) (err error) {
+	ctx, done, err := u.hook(ctx, "update")
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return u.updater.Update(ctx, key, fn)
+}
+
+type wrappedScanner struct {
+	scanner Scanner
+	hook    Hook
+}
+
+func (s *wrappedScanner) Scan(ctx context.Context, pattern string, fn func(key string) error) (err error) {
+	ctx, done, err := s.hook(ctx, "scan")
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	return s.scanner.Scan(ctx, pattern, fn)
+}
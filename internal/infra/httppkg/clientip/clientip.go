@@ -0,0 +1,180 @@
+// Package clientip resolves the IP of the client behind the trusted reverse proxies from the X-Forwarded-For,
+// X-Real-IP and RFC 7239 Forwarded headers, and derives the rate limit keys from it.
+package clientip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// Resolver trusts the forwarding headers only when they were set by one of its proxies. The zero Resolver trusts no
+// proxy and always returns the peer address.
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// NewResolver parses a comma separated list of CIDRs or single IPs, such as "10.0.0.0/8, 192.168.1.10".
+func NewResolver(proxies string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, entry := range strings.Split(proxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: expected a CIDR or an IP", entry)
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		r.trusted = append(r.trusted, prefix.Masked())
+	}
+	return r, nil
+}
+
+type cached struct {
+	proxies  string
+	resolver *Resolver
+}
+
+var last atomic.Pointer[cached]
+
+// For returns the Resolver of proxies, parsing them again only when they differ from the previous call, so it can be
+// called on every request with the TRUSTED_PROXIES of the current configuration. Invalid lists, which the
+// configuration validation rejects, trust no proxy.
+func For(proxies string) *Resolver {
+	if c := last.Load(); c != nil && c.proxies == proxies {
+		return c.resolver
+	}
+
+	r, err := NewResolver(proxies)
+	if err != nil {
+		r = &Resolver{}
+	}
+	last.Store(&cached{proxies: proxies, resolver: r})
+	return r
+}
+
+// Trusts reports whether addr belongs to a trusted proxy.
+func (r *Resolver) Trusts(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client that sent req, without port. When the peer is a trusted proxy, the forwarding
+// chain of the Forwarded header, or of X-Forwarded-For when it is missing, is walked from the right and the first hop
+// that is not a trusted proxy wins, as the hops on its left could have been forged by the client. X-Real-IP is used
+// when neither header is present. Requests from untrusted peers are identified by the peer address alone.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	peer, ok := parseHost(req.RemoteAddr)
+	if !ok {
+		return req.RemoteAddr
+	}
+	if !r.Trusts(peer) {
+		return peer.String()
+	}
+
+	hops, found := forwarded(req.Header.Values("Forwarded"))
+	if !found {
+		hops = forwardedFor(req.Header.Values("X-Forwarded-For"))
+	}
+	if len(hops) == 0 {
+		if realIP, ok := parseHost(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ok {
+			return realIP.String()
+		}
+		return peer.String()
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHost(hops[i])
+		if !ok {
+			// An obfuscated or unknown hop cannot be attributed, so the proxy that reported it stands for it.
+			break
+		}
+		client = hop
+		if !r.Trusts(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwarded returns the for= parameters of the RFC 7239 Forwarded header values, in order, and whether the header is
+// present.
+func forwarded(values []string) ([]string, bool) {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(v, `"`))
+				}
+			}
+		}
+	}
+	return hops, len(values) > 0
+}
+
+// forwardedFor returns the addresses of the X-Forwarded-For header values, in order.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// parseHost parses an IP optionally followed by a port, IPv6 addresses being bracketed when they carry one.
+func parseHost(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// Key returns the rate limit key part identifying ip, with or without port: the canonical form of IPv4 addresses, and
+// of IPv6 ones masked to their first ipv6Prefix bits so that a client cannot escape its limit by rotating addresses
+// within its network, for instance "2001:db8:1:2::/64". IPv4-mapped IPv6 addresses are keyed as IPv4. A prefix of
+// zero or 128 keys each IPv6 address separately. Values that are not IPs are hashed.
+func Key(ip string, ipv6Prefix int) string {
+	if ip == "" {
+		return ""
+	}
+
+	addr, ok := parseHost(ip)
+	if !ok {
+		sum := sha256.Sum256([]byte(ip))
+		return "h" + hex.EncodeToString(sum[:16])
+	}
+	if addr.Is4() || ipv6Prefix <= 0 || ipv6Prefix >= 128 {
+		return addr.String()
+	}
+	return netip.PrefixFrom(addr, ipv6Prefix).Masked().String()
+}
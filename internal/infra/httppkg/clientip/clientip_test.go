@@ -0,0 +1,98 @@
+package clientip
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewResolver(t *testing.T) {
+	r, err := NewResolver(" 10.0.0.0/8, 192.168.1.10 ,2001:db8::/32,")
+	require.NoError(t, err)
+	assert.Len(t, r.trusted, 3)
+
+	for _, proxies := range []string{"10.0.0.0/33", "proxy.local", "10.0.0.1/8/8"} {
+		_, err := NewResolver(proxies)
+		assert.Error(t, err, proxies)
+	}
+
+	empty, err := NewResolver("")
+	require.NoError(t, err)
+	assert.Empty(t, empty.trusted)
+}
+
+func TestClientIP(t *testing.T) {
+	r, err := NewResolver("10.0.0.0/8, 2001:db8::/32")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		expected   string
+	}{
+		{"Untrusted peer ignores the headers", "203.0.113.7:4000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.7"},
+		{"Trusted peer without headers", "10.0.0.1:4000", nil, "10.0.0.1"},
+		{"Single X-Forwarded-For hop", "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"Right-most untrusted X-Forwarded-For hop", "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"Repeated X-Forwarded-For headers", "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"Only trusted hops", "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"Unknown hop", "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"198.51.100.1, garbage, 10.0.0.2"}}, "10.0.0.2"},
+		{"X-Real-IP", "10.0.0.1:4000", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"X-Forwarded-For wins over X-Real-IP", "10.0.0.1:4000", http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Ip": {"198.51.100.2"}}, "198.51.100.1"},
+		{"Forwarded", "10.0.0.1:4000", http.Header{"Forwarded": {`for=198.51.100.1;proto=https, for="10.0.0.2:8080"`}}, "198.51.100.1"},
+		{"Forwarded IPv6", "[2001:db8::1]:4000", http.Header{"Forwarded": {`For="[2001:db9::17]:4711"`}}, "2001:db9::17"},
+		{"Forwarded wins over X-Forwarded-For", "10.0.0.1:4000", http.Header{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"198.51.100.2"}}, "198.51.100.1"},
+		{"Obfuscated Forwarded hop", "10.0.0.1:4000", http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}}, "10.0.0.2"},
+		{"IPv4-mapped peer", "[::ffff:10.0.0.1]:4000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"Peer without port", "203.0.113.7", nil, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: tt.remoteAddr, Header: tt.header}
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			assert.Equal(t, tt.expected, r.ClientIP(req))
+		})
+	}
+}
+
+func TestFor(t *testing.T) {
+	first := For("10.0.0.0/8")
+	assert.Same(t, first, For("10.0.0.0/8"))
+	assert.NotSame(t, first, For("192.168.0.0/16"))
+
+	req := &http.Request{RemoteAddr: "10.0.0.1:80", Header: http.Header{"X-Forwarded-For": {"198.51.100.1"}}}
+	assert.Equal(t, "10.0.0.1", For("invalid").ClientIP(req))
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		ip       string
+		prefix   int
+		expected string
+	}{
+		{"1.23.4.5:80", 64, "1.23.4.5"},
+		{"12.3.45.80", 64, "12.3.45.80"},
+		{"1.23.4.5:81", 64, "1.23.4.5"},
+		{"::ffff:1.23.4.5", 64, "1.23.4.5"},
+		{"2001:DB8:0:0:1::1", 0, "2001:db8::1:0:0:1"},
+		{"[2001:db8::1]:443", 128, "2001:db8::1"},
+		{"2001:db8:1:2:aaaa::1", 64, "2001:db8:1:2::/64"},
+		{"[2001:db8:1:2:bbbb::2]:443", 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", 64, "2001:db8:1:3::/64"},
+		{"2001:db8:1:3::1", 48, "2001:db8:1::/48"},
+		{"fe80::1%eth0", 128, "fe80::1"},
+		{"", 64, ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, Key(tt.ip, tt.prefix), "%s /%d", tt.ip, tt.prefix)
+	}
+
+	hashed := Key("not an ip", 64)
+	assert.Regexp(t, "^h[0-9a-f]{32}$", hashed)
+	assert.NotEqual(t, hashed, Key("not an ip either", 64))
+}
@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/access"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/logging"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admin registers the routes inspecting and changing the state of the rate limit keys, such as rate_limiter_127.0.0.1.
+// Keys are given in full after the route, URL-encoded when needed, and the routes answer 404 unless ADMIN_TOKEN is set
+// and sent as a bearer token.
+//
+//	GET    /keys/{key}             usage, remaining and ban of the key, under the ?policy= rule or the default policy
+//	DELETE /keys/{key}             forgets the requests, the ban and the offenses of the key
+//	GET    /bans                   bans in effect
+//	PUT    /bans/{key}             bans the key for ?duration=, with an optional ?reason=
+//	DELETE /bans/{key}             lifts the ban of the key
+//	GET    /access/{list}          runtime entries in effect on the allow or deny list
+//	PUT    /access/{list}/{entry}  puts the IP, CIDR or sub:<subject> on the list, for an optional ?ttl=
+//	DELETE /access/{list}/{entry}  takes the entry off the list
+//
+// The access routes are only registered when accessStore is not nil.
+func Admin(adminRepository entity.AdminRepositoryInterface, policies *policy.Holder, accessStore *access.Store) http.Handler {
+	a := &admin{repository: adminRepository, policies: policies, access: accessStore}
+
+	r := chi.NewRouter()
+	r.Use(authenticate)
+
+	r.Get("/keys/*", a.usage)
+	r.Delete("/keys/*", a.reset)
+	r.Get("/bans", a.bans)
+	r.Put("/bans/*", a.ban)
+	r.Delete("/bans/*", a.unban)
+	if accessStore != nil {
+		r.Get("/access/{list}", a.accessEntries)
+		r.Put("/access/{list}/*", a.accessAdd)
+		r.Delete("/access/{list}/*", a.accessRemove)
+	}
+	return r
+}
+
+type admin struct {
+	repository entity.AdminRepositoryInterface
+	policies   *policy.Holder
+	access     *access.Store
+}
+
+// authenticate hides the admin routes unless the request carries the ADMIN_TOKEN of the current configuration.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if confpkg.Current().AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateScrape requires the METRICS_TOKEN of the current configuration, when one is set, to scrape the
+// metrics.
+func authenticateScrape(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := confpkg.Current().MetricsToken; token != "" && !hasBearer(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "invalid metrics token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether r carries the ADMIN_TOKEN of the current configuration as a bearer token.
+func isAdmin(r *http.Request) bool {
+	return hasBearer(r, confpkg.Current().AdminToken)
+}
+
+// hasBearer reports whether r carries token, when not empty, as a bearer token.
+func hasBearer(r *http.Request, token string) bool {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
+
+func (a *admin) usage(w http.ResponseWriter, r *http.Request) {
+	key, p, ok := a.target(w, r)
+	if !ok {
+		return
+	}
+
+	usage, err := a.repository.Usage(r.Context(), key, p)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("admin: reading the key failed", "key", key, "error", err)
+		http.Error(w, "error reading the key", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+func (a *admin) reset(w http.ResponseWriter, r *http.Request) {
+	key, p, ok := a.target(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.repository.Reset(r.Context(), key, p); err != nil {
+		logging.FromContext(r.Context()).Error("admin: resetting the key failed", "key", key, "error", err)
+		http.Error(w, "error resetting the key", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) bans(w http.ResponseWriter, r *http.Request) {
+	bans, err := a.repository.ListBans(r.Context())
+	if errors.Is(err, cache.ErrNotSupported) {
+		http.Error(w, "the cache backend cannot list the bans", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("admin: listing the bans failed", "error", err)
+		http.Error(w, "error listing the bans", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, bans)
+}
+
+func (a *admin) ban(w http.ResponseWriter, r *http.Request) {
+	key, ok := adminKey(w, r)
+	if !ok {
+		return
+	}
+
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil || d <= 0 {
+		http.Error(w, "invalid duration", http.StatusBadRequest)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = entity.BanReasonAdmin
+	}
+
+	b, err := a.repository.Ban(r.Context(), key, reason, d)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("admin: banning the key failed", "key", key, "error", err)
+		http.Error(w, "error banning the key", http.StatusInternalServerError)
+		return
+	}
+	logging.FromContext(r.Context()).Info("admin: key banned", "key", key, "reason", reason, "until", b.Until)
+	writeJSON(w, http.StatusOK, b)
+}
+
+func (a *admin) unban(w http.ResponseWriter, r *http.Request) {
+	key, ok := adminKey(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.repository.Unban(r.Context(), key); err != nil {
+		logging.FromContext(r.Context()).Error("admin: unbanning the key failed", "key", key, "error", err)
+		http.Error(w, "error unbanning the key", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) accessEntries(w http.ResponseWriter, r *http.Request) {
+	kind, ok := accessList(w, r)
+	if !ok {
+		return
+	}
+
+	entries, err := a.access.Entries(r.Context(), kind)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("admin: reading the access list failed", "list", kind, "error", err)
+		http.Error(w, "error reading the access list", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []access.Entry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (a *admin) accessAdd(w http.ResponseWriter, r *http.Request) {
+	kind, value, ok := accessEntry(w, r)
+	if !ok {
+		return
+	}
+
+	var ttl time.Duration
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	entry, err := a.access.Add(r.Context(), kind, value, ttl)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("admin: adding the access entry failed", "list", kind, "entry", value, "error", err)
+		http.Error(w, "error adding the access entry", http.StatusInternalServerError)
+		return
+	}
+	logging.FromContext(r.Context()).Info("admin: access entry added", "list", kind, "entry", entry.Value, "until", entry.Until)
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func (a *admin) accessRemove(w http.ResponseWriter, r *http.Request) {
+	kind, value, ok := accessEntry(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.access.Remove(r.Context(), kind, value); err != nil {
+		logging.FromContext(r.Context()).Error("admin: removing the access entry failed", "list", kind, "entry", value, "error", err)
+		http.Error(w, "error removing the access entry", http.StatusInternalServerError)
+		return
+	}
+	logging.FromContext(r.Context()).Info("admin: access entry removed", "list", kind, "entry", value)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// accessList returns the list named by the route, allow or deny.
+func accessList(w http.ResponseWriter, r *http.Request) (string, bool) {
+	kind := chi.URLParam(r, "list")
+	if kind != access.Allow && kind != access.Deny {
+		http.Error(w, "unknown access list", http.StatusNotFound)
+		return "", false
+	}
+	return kind, true
+}
+
+// accessEntry returns the list named by the route and the entry following it, normalized.
+func accessEntry(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	kind, ok := accessList(w, r)
+	if !ok {
+		return "", "", false
+	}
+	value, ok := wildcard(w, r, "entry")
+	if !ok {
+		return "", "", false
+	}
+	value, err := access.Normalize(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	return kind, value, true
+}
+
+// target returns the key of the request and the policy it is read under: the rule named by the policy parameter, or
+// the default policy with the limit parameter, DEFAULT_MAX_REQ_PER_SEC when absent.
+func (a *admin) target(w http.ResponseWriter, r *http.Request) (string, entity.Policy, bool) {
+	key, ok := adminKey(w, r)
+	if !ok {
+		return "", entity.Policy{}, false
+	}
+
+	query := r.URL.Query()
+	if name := query.Get("policy"); name != "" && name != policy.DefaultName {
+		rule, ok := a.policies.Get().Rule(name)
+		if !ok {
+			http.Error(w, "unknown policy", http.StatusNotFound)
+			return "", entity.Policy{}, false
+		}
+		return key, rule.Policy(), true
+	}
+
+	limit := confpkg.Current().DefaultMaxReqPerSec
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return "", entity.Policy{}, false
+		}
+		limit = n
+	}
+	return key, policy.Default(limit), true
+}
+
+// adminKey returns the key following the route, which may contain slashes, as IPv6 prefixes do.
+func adminKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return wildcard(w, r, "key")
+}
+
+// wildcard returns the part of the path matched by the wildcard of the route, unescaped, answering 400 when it is
+// missing. name describes it in the errors.
+func wildcard(w http.ResponseWriter, r *http.Request, name string) (string, bool) {
+	key := chi.URLParam(r, "*")
+	if r.URL.RawPath != "" {
+		// chi routes on the escaped path when there is one.
+		unescaped, err := url.PathUnescape(key)
+		if err != nil {
+			http.Error(w, "invalid "+name, http.StatusBadRequest)
+			return "", false
+		}
+		key = unescaped
+	}
+	if key == "" {
+		http.Error(w, "missing "+name, http.StatusBadRequest)
+		return "", false
+	}
+	return key, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/access"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"github.com/mayckol/rate-limiter/internal/infra/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withConf activates a copy of the current configuration, changed by change when not nil, until the end of the test.
+// The returned configuration is the active one, so that the test can keep changing it.
+func withConf(t *testing.T, change func(conf *confpkg.Conf)) *confpkg.Conf {
+	t.Helper()
+	previous := confpkg.Current()
+	conf := *previous
+	if change != nil {
+		change(&conf)
+	}
+	confpkg.Activate(&conf)
+	t.Cleanup(func() { confpkg.Activate(previous) })
+	return &conf
+}
+
+func TestAdmin(t *testing.T) {
+	_, _, err := confpkg.LoadConfig(true)
+	require.NoError(t, err)
+	withConf(t, func(conf *confpkg.Conf) {
+		conf.AdminToken = "secret"
+	})
+
+	client, err := memory.NewMemoryClient(&memory.ClientSettings{})
+	require.NoError(t, err)
+	defer client.Close()
+	repo := repository.NewRequestRepository(client, limiter.NewFixedWindow(client))
+	rules, err := policy.NewSet([]policy.Rule{{Name: "login", Path: "/login", Limit: 5, Window: policy.Duration(time.Minute)}})
+	require.NoError(t, err)
+	store := access.NewStore(client)
+	handler := Admin(repo, policy.NewHolder(rules), store)
+
+	serve := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Requires the admin token", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, serve("GET", "/bans", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, serve("GET", "/bans", "wrong").Code)
+
+		withConf(t, func(conf *confpkg.Conf) {
+			conf.AdminToken = ""
+		})
+		assert.Equal(t, http.StatusNotFound, serve("GET", "/bans", "").Code)
+	})
+
+	t.Run("Reports the usage of a key", func(t *testing.T) {
+		_, err := repo.CheckRateLimit(context.Background(), "rate_limiter_login_10.0.0.1", rules.Rules()[0].Policy())
+		require.NoError(t, err)
+
+		rr := serve("GET", "/keys/rate_limiter_login_10.0.0.1?policy=login", "secret")
+		require.Equal(t, http.StatusOK, rr.Code)
+		var usage entity.Usage
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&usage))
+		assert.Equal(t, "login", usage.Policy)
+		assert.Equal(t, 1, usage.Used)
+		assert.Equal(t, 4, usage.Remaining)
+
+		rr = serve("GET", "/keys/rate_limiter_10.0.0.1?limit=7", "secret")
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&usage))
+		assert.Equal(t, policy.DefaultName, usage.Policy)
+		assert.Equal(t, 7, usage.Remaining)
+
+		assert.Equal(t, http.StatusNotFound, serve("GET", "/keys/key?policy=unknown", "secret").Code)
+		assert.Equal(t, http.StatusBadRequest, serve("GET", "/keys/key?limit=0", "secret").Code)
+	})
+
+	t.Run("Bans, lists and unbans keys with slashes", func(t *testing.T) {
+		key := "rate_limiter_2001:db8::/64"
+
+		rr := serve("PUT", "/bans/"+key+"?duration=1h&reason=abuse", "secret")
+		require.Equal(t, http.StatusOK, rr.Code)
+		var b entity.Ban
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&b))
+		assert.Equal(t, key, b.Key)
+		assert.Equal(t, "abuse", b.Reason)
+
+		rr = serve("GET", "/bans", "secret")
+		require.Equal(t, http.StatusOK, rr.Code)
+		var bans []entity.Ban
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&bans))
+		if assert.Len(t, bans, 1) {
+			assert.Equal(t, key, bans[0].Key)
+		}
+
+		assert.Equal(t, http.StatusNoContent, serve("DELETE", "/bans/rate_limiter_2001:db8::%2F64", "secret").Code)
+		rr = serve("GET", "/bans", "secret")
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&bans))
+		assert.Empty(t, bans)
+
+		assert.Equal(t, http.StatusBadRequest, serve("PUT", "/bans/"+key+"?duration=soon", "secret").Code)
+	})
+
+	t.Run("Resets a key", func(t *testing.T) {
+		key := "rate_limiter_login_10.0.0.2"
+		p := rules.Rules()[0].Policy()
+		for i := 0; i < 6; i++ {
+			_, err := repo.CheckRateLimit(context.Background(), key, p)
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, http.StatusNoContent, serve("DELETE", "/keys/"+key+"?policy=login", "secret").Code)
+		decision, err := repo.CheckRateLimit(context.Background(), key, p)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("Manages the runtime access lists", func(t *testing.T) {
+		rr := serve("PUT", "/access/deny/203.0.113.0/24?ttl=1h", "secret")
+		require.Equal(t, http.StatusOK, rr.Code)
+		var entry access.Entry
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&entry))
+		assert.Equal(t, "203.0.113.0/24", entry.Value)
+		require.NotNil(t, entry.Until)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *entry.Until, time.Minute)
+
+		rr = serve("PUT", "/access/allow/sub:health", "secret")
+		require.Equal(t, http.StatusOK, rr.Code)
+		var permanent access.Entry
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&permanent))
+		assert.Nil(t, permanent.Until, "permanent without a ttl")
+
+		verdict, err := store.Check(context.Background(), nil, nil, "203.0.113.7", "")
+		require.NoError(t, err)
+		assert.Equal(t, access.Denied, verdict)
+		verdict, err = store.Check(context.Background(), nil, nil, "192.0.2.1", "health")
+		require.NoError(t, err)
+		assert.Equal(t, access.Allowed, verdict)
+
+		rr = serve("GET", "/access/deny", "secret")
+		require.Equal(t, http.StatusOK, rr.Code)
+		var entries []access.Entry
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&entries))
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, "203.0.113.0/24", entries[0].Value)
+		}
+
+		assert.Equal(t, http.StatusNoContent, serve("DELETE", "/access/deny/203.0.113.0%2F24", "secret").Code)
+		rr = serve("GET", "/access/deny", "secret")
+		assert.JSONEq(t, "[]", rr.Body.String())
+		verdict, err = store.Check(context.Background(), nil, nil, "203.0.113.7", "")
+		require.NoError(t, err)
+		assert.Equal(t, access.None, verdict)
+
+		assert.Equal(t, http.StatusUnauthorized, serve("PUT", "/access/deny/192.0.2.1", "").Code)
+		assert.Equal(t, http.StatusNotFound, serve("GET", "/access/maybe", "secret").Code)
+		assert.Equal(t, http.StatusBadRequest, serve("PUT", "/access/deny/not-an-ip", "secret").Code)
+		assert.Equal(t, http.StatusBadRequest, serve("PUT", "/access/deny/192.0.2.1?ttl=-1s", "secret").Code)
+	})
+}
@@ -4,23 +4,40 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/access"
 	"github.com/mayckol/rate-limiter/internal/infra/httppkg/middlewarepkg"
+	"github.com/mayckol/rate-limiter/internal/infra/logging"
+	"github.com/mayckol/rate-limiter/internal/infra/metrics"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"github.com/mayckol/rate-limiter/internal/infra/tracing"
+	"log/slog"
 	"net/http"
 )
 
-func Handler(reqRepository entity.RequestRepositoryInterface) http.Handler {
+// Handler registers the routes. Every route of the rate limited group is checked against the rules of policies, or the
+// default policy when none matches, after the allow and deny lists. The admin API is mounted under /admin and the
+// Prometheus metrics are served on /metrics, behind the METRICS_TOKEN when set. Every request is traced, continuing
+// the trace context of the caller, and logged with logger under a request ID.
+func Handler(reqRepository entity.RequestRepositoryInterface, adminRepository entity.AdminRepositoryInterface, policies *policy.Holder, accessStore *access.Store, stats *metrics.Metrics, logger *slog.Logger) http.Handler {
 	r := chi.NewRouter()
 
-	m := middlewarepkg.NewRateLimiterMiddleware(reqRepository)
-	r.Use(middleware.Logger)
+	m := middlewarepkg.NewRateLimiterMiddleware(stats.Repository(tracing.Repository(reqRepository)), policies, accessStore, stats)
+	r.Use(tracing.Middleware, middleware.RequestID, logging.Middleware(logger))
 
-	r.Get("/token", Token)
+	r.Mount("/admin", Admin(adminRepository, policies, accessStore))
+	r.Handle("/metrics", authenticateScrape(stats.Handler()))
 
-	r.With(m.SetJWTClaimsMiddleware, m.RateLimitMiddleware).Get("/rate-limiter-active", func(w http.ResponseWriter, r *http.Request) {
-		_, err := w.Write([]byte("success"))
-		if err != nil {
-			return
-		}
+	r.Group(func(r chi.Router) {
+		r.Use(m.SetJWTClaimsMiddleware, m.RateLimitMiddleware)
+
+		// Issuing tokens is limited like the other routes, so that clients cannot mint them without bound.
+		r.Get("/token", Token)
+		r.Get("/rate-limiter-active", func(w http.ResponseWriter, r *http.Request) {
+			_, err := w.Write([]byte("success"))
+			if err != nil {
+				return
+			}
+		})
 	})
 	return r
 }
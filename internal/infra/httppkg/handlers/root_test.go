@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"github.com/mayckol/rate-limiter/internal/infra/metrics"
+	"github.com/mayckol/rate-limiter/internal/infra/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerMetrics(t *testing.T) {
+	_, _, err := confpkg.LoadConfig(true)
+	require.NoError(t, err)
+	conf := withConf(t, nil)
+
+	client, err := memory.NewMemoryClient(&memory.ClientSettings{})
+	require.NoError(t, err)
+	defer client.Close()
+	repo := repository.NewRequestRepository(client, limiter.NewFixedWindow(client))
+	handler := Handler(repo, repo, nil, nil, metrics.New(), slog.Default())
+
+	scrape := func(token string) int {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	conf.AdminToken = "admin"
+	conf.MetricsToken = ""
+	assert.Equal(t, http.StatusOK, scrape(""), "open without a metrics token")
+
+	conf.MetricsToken = "secret"
+	assert.Equal(t, http.StatusUnauthorized, scrape(""))
+	assert.Equal(t, http.StatusUnauthorized, scrape("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, scrape("admin"), "the admin token does not scrape")
+	assert.Equal(t, http.StatusOK, scrape("secret"))
+}
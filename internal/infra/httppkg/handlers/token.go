@@ -2,14 +2,18 @@ package handlers
 
 import (
 	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/infra/httppkg/clientip"
 	"github.com/mayckol/rate-limiter/internal/tokenpkg"
 	"net/http"
 	"strconv"
 	"time"
 )
 
+// Token issues a token for the client IP. Anyone may ask for a token, so only the requests carrying the ADMIN_TOKEN may
+// ask for a max_req_per_sec above DEFAULT_MAX_REQ_PER_SEC or choose the ban duration with block_sec.
 func Token(w http.ResponseWriter, r *http.Request) {
-	maxReqPerSec := confpkg.Config.DefaultMaxReqPerSec
+	conf := confpkg.Current()
+	maxReqPerSec := conf.DefaultMaxReqPerSec
 	queryReqPerSec := r.URL.Query().Get("max_req_per_sec")
 	if queryReqPerSec != "" {
 		reqPerSec, err := strconv.Atoi(queryReqPerSec)
@@ -17,10 +21,14 @@ func Token(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "invalid max_req_per_sec", http.StatusBadRequest)
 			return
 		}
+		if reqPerSec > maxReqPerSec && !isAdmin(r) {
+			http.Error(w, "max_req_per_sec above DEFAULT_MAX_REQ_PER_SEC requires the admin token", http.StatusForbidden)
+			return
+		}
 		maxReqPerSec = reqPerSec
 	}
 
-	tokenExpiresIn := time.Duration(confpkg.Config.TokenExpiresInSec) * time.Second
+	tokenExpiresIn := time.Duration(conf.TokenExpiresInSec) * time.Second
 	expiration := r.URL.Query().Get("token_expires_in_sec")
 	if expiration != "" {
 		expires, err := strconv.Atoi(expiration)
@@ -31,8 +39,23 @@ func Token(w http.ResponseWriter, r *http.Request) {
 		tokenExpiresIn = time.Duration(expires) * time.Second
 	}
 
-	ip := r.RemoteAddr
-	token, err := tokenpkg.NewJWT(ip, tokenExpiresIn, maxReqPerSec)
+	blockSec := 0
+	block := r.URL.Query().Get("block_sec")
+	if block != "" {
+		sec, err := strconv.Atoi(block)
+		if err != nil || sec <= 0 {
+			http.Error(w, "invalid block_sec", http.StatusBadRequest)
+			return
+		}
+		if !isAdmin(r) {
+			http.Error(w, "block_sec requires the admin token", http.StatusForbidden)
+			return
+		}
+		blockSec = sec
+	}
+
+	ip := clientip.For(conf.TrustedProxies).ClientIP(r)
+	token, err := tokenpkg.NewJWT(ip, tokenExpiresIn, maxReqPerSec, blockSec)
 	if err != nil {
 		http.Error(w, "error generating token", http.StatusInternalServerError)
 		return
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"github.com/mayckol/rate-limiter/internal/infra/metrics"
+	"github.com/mayckol/rate-limiter/internal/infra/repository"
+	"github.com/mayckol/rate-limiter/internal/tokenpkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToken(t *testing.T) {
+	_, _, err := confpkg.LoadConfig(true)
+	require.NoError(t, err)
+	withConf(t, func(conf *confpkg.Conf) {
+		conf.AdminToken = "secret"
+		conf.DefaultMaxReqPerSec = 2
+		// The sliding log has no window boundary the requests could straddle.
+		conf.RateLimitAlgorithm = limiter.AlgorithmSlidingLog
+	})
+
+	serve := func(handler http.Handler, target, apiKey, adminToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if apiKey != "" {
+			req.Header.Set("API_KEY", apiKey)
+		}
+		if adminToken != "" {
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	newHandler := func(t *testing.T) http.Handler {
+		client, err := memory.NewMemoryClient(&memory.ClientSettings{})
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		repo := repository.NewRequestRepository(client, limiter.NewFixedWindow(client))
+		return Handler(repo, repo, nil, nil, metrics.New(), slog.Default())
+	}
+
+	t.Run("Tokens minted from one IP share their limit", func(t *testing.T) {
+		// Every token has its own count, so the IP limit counted along with it by default is what they share: 4
+		// requests, 2 of them minting the tokens.
+		withConf(t, func(conf *confpkg.Conf) {
+			conf.DefaultMaxReqPerSec = 4
+			conf.TokenLimitPrecedence = ""
+		})
+
+		handler := newHandler(t)
+		first := serve(handler, "/token", "", "")
+		require.Equal(t, http.StatusOK, first.Code)
+		second := serve(handler, "/token", "", "")
+		require.Equal(t, http.StatusOK, second.Code)
+
+		assert.Equal(t, http.StatusOK, serve(handler, "/rate-limiter-active", first.Header().Get("Api-Key"), "").Code)
+		assert.Equal(t, http.StatusOK, serve(handler, "/rate-limiter-active", first.Header().Get("Api-Key"), "").Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "/rate-limiter-active", second.Header().Get("Api-Key"), "").Code)
+	})
+
+	t.Run("Limits the issuing of tokens", func(t *testing.T) {
+		handler := newHandler(t)
+		assert.Equal(t, http.StatusOK, serve(handler, "/token", "", "").Code)
+		assert.Equal(t, http.StatusOK, serve(handler, "/token", "", "").Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "/token", "", "").Code)
+	})
+
+	t.Run("Requires the admin token above the default limit", func(t *testing.T) {
+		handler := newHandler(t)
+		assert.Equal(t, http.StatusForbidden, serve(handler, "/token?max_req_per_sec=100", "", "wrong").Code)
+
+		rr := serve(handler, "/token?max_req_per_sec=100", "", "secret")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NotEmpty(t, rr.Header().Get("Api-Key"))
+	})
+
+	t.Run("Requires the admin token to choose the ban duration", func(t *testing.T) {
+		handler := newHandler(t)
+		assert.Equal(t, http.StatusForbidden, serve(handler, "/token?block_sec=1", "", "").Code)
+
+		rr := serve(handler, "/token?block_sec=60", "", "secret")
+		require.Equal(t, http.StatusOK, rr.Code)
+		claims := &tokenpkg.Claims{}
+		_, err := jwt.ParseWithClaims(rr.Header().Get("Api-Key"), claims, func(token *jwt.Token) (interface{}, error) {
+			return tokenpkg.JwtKey(), nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 60, claims.BlockSec)
+	})
+}
@@ -0,0 +1,42 @@
+package middlewarepkg
+
+import (
+	"fmt"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// setRateLimitHeaders writes the RateLimit header fields from the IETF httpapi-ratelimit-headers draft, along with the
+// legacy X-RateLimit ones when RATE_LIMIT_LEGACY_HEADERS is enabled. Retry-After is only set on rejected requests.
+func setRateLimitHeaders(h http.Header, decision *entity.Decision) {
+	limit := strconv.Itoa(decision.Limit)
+	remaining := strconv.Itoa(max(decision.Remaining, 0))
+
+	h.Set("RateLimit-Limit", limit)
+	h.Set("RateLimit-Remaining", remaining)
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(time.Until(decision.ResetAt))))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", decision.Limit, max(seconds(decision.Window), 1)))
+
+	if confpkg.Current().RateLimitLegacyHeaders {
+		h.Set("X-RateLimit-Limit", limit)
+		h.Set("X-RateLimit-Remaining", remaining)
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(decision.ResetAt.Unix(), 10))
+	}
+
+	if !decision.Allowed {
+		h.Set("Retry-After", strconv.Itoa(max(seconds(decision.RetryAfter), 1)))
+	}
+}
+
+// seconds rounds d up to whole seconds, as header fields only carry integers and rounding down would make clients
+// retry too early.
+func seconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
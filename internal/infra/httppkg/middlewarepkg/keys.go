@@ -0,0 +1,164 @@
+package middlewarepkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/infra/httppkg/clientip"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"github.com/mayckol/rate-limiter/internal/tokenpkg"
+	"net/http"
+	"strings"
+)
+
+// KeyExtractor returns the part of the rate limit key identifying who or what a request is limited by, and false when
+// the request lacks it.
+type KeyExtractor interface {
+	Extract(r *http.Request) (string, bool)
+}
+
+// KeyExtractorFunc adapts a function to a KeyExtractor.
+type KeyExtractorFunc func(r *http.Request) (string, bool)
+
+func (f KeyExtractorFunc) Extract(r *http.Request) (string, bool) {
+	return f(r)
+}
+
+// IPKey extracts the client IP of the request claims, IPv6 addresses grouped by the IPV6_PREFIX_LENGTH of the current
+// configuration.
+func IPKey() KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		claims, ok := r.Context().Value("claims").(*tokenpkg.Claims)
+		if !ok || claims.IP == "" {
+			return "", false
+		}
+		return clientip.Key(claims.IP, confpkg.Current().IPv6PrefixLength), true
+	})
+}
+
+// APIKey extracts the token sent in the API_KEY header, so that every token is limited separately.
+func APIKey() KeyExtractor {
+	return HeaderKey("API_KEY")
+}
+
+// SubjectKey extracts the sub claim of the JWT token.
+func SubjectKey() KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		claims, ok := r.Context().Value("claims").(*tokenpkg.Claims)
+		if !ok || claims.Subject == "" {
+			return "", false
+		}
+		return hash(claims.Subject), true
+	})
+}
+
+// TokenKey extracts the identity of the JWT token, its sub claim or its jti.
+func TokenKey() KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		claims, ok := r.Context().Value("claims").(*tokenpkg.Claims)
+		if !ok || claims.Identity() == "" {
+			return "", false
+		}
+		return hash(claims.Identity()), true
+	})
+}
+
+// HeaderKey extracts the value of the header name.
+func HeaderKey(name string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		if value := r.Header.Get(name); value != "" {
+			return hash(value), true
+		}
+		return "", false
+	})
+}
+
+// QueryKey extracts the value of the query parameter name.
+func QueryKey(name string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		if value := r.URL.Query().Get(name); value != "" {
+			return hash(value), true
+		}
+		return "", false
+	})
+}
+
+// RouteKey extracts the pattern of the route the request matched, such as "/users/{id}", or its path when it did not
+// go through a chi router.
+func RouteKey() KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		route := r.URL.Path
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		if route == "" {
+			return "", false
+		}
+		if strings.ContainsFunc(route, func(c rune) bool { return c <= ' ' || c == 0x7f }) {
+			return hash(route), true
+		}
+		return route, true
+	})
+}
+
+// Composite joins the parts of extractors, the ones a request lacks replaced by its client IP, so that "user and
+// route" still limits anonymous requests per IP and route.
+func Composite(extractors ...KeyExtractor) KeyExtractor {
+	ip := IPKey()
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		parts := make([]string, len(extractors))
+		for i, extractor := range extractors {
+			part, ok := extractor.Extract(r)
+			if !ok {
+				if part, ok = ip.Extract(r); !ok {
+					return "", false
+				}
+			}
+			parts[i] = part
+		}
+		return strings.Join(parts, "_"), true
+	})
+}
+
+// NewKeyExtractor returns the extractor of a policy key, as parsed by policy.ParseKey.
+func NewKeyExtractor(key string) (KeyExtractor, error) {
+	sources, err := policy.ParseKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	extractors := make([]KeyExtractor, len(sources))
+	for i, source := range sources {
+		switch source.Kind {
+		case policy.KeyIP:
+			extractors[i] = IPKey()
+		case policy.KeyAPIKey:
+			extractors[i] = APIKey()
+		case policy.KeySubject:
+			extractors[i] = SubjectKey()
+		case policy.KeyToken:
+			extractors[i] = TokenKey()
+		case policy.KeyRoute:
+			extractors[i] = RouteKey()
+		case policy.KeyHeaderPrefix:
+			extractors[i] = HeaderKey(source.Name)
+		case policy.KeyQueryPrefix:
+			extractors[i] = QueryKey(source.Name)
+		default:
+			return nil, fmt.Errorf("unknown key source %q", source.Kind)
+		}
+	}
+
+	if len(extractors) == 1 {
+		return extractors[0], nil
+	}
+	return Composite(extractors...), nil
+}
+
+// hash keeps keys short and free of characters the cache backends reject.
+func hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "h" + hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,115 @@
+package middlewarepkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/tokenpkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newKeyRequest(target string, claims *tokenpkg.Claims) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if claims != nil {
+		req = req.WithContext(context.WithValue(req.Context(), "claims", claims))
+	}
+	return req
+}
+
+func TestKeyExtractors(t *testing.T) {
+	confpkg.LoadConfig(true)
+
+	claims := &tokenpkg.Claims{IP: "198.51.100.1", RegisteredClaims: jwt.RegisteredClaims{Subject: "user-1"}}
+	req := newKeyRequest("/search?client_id=abc", claims)
+	req.Header.Set("API_KEY", "token")
+	req.Header.Set("X-Tenant", "acme")
+
+	t.Run("Built-in extractors", func(t *testing.T) {
+		key, ok := IPKey().Extract(req)
+		assert.True(t, ok)
+		assert.Equal(t, "198.51.100.1", key)
+
+		key, ok = SubjectKey().Extract(req)
+		assert.True(t, ok)
+		assert.Equal(t, hash("user-1"), key)
+
+		key, ok = APIKey().Extract(req)
+		assert.True(t, ok)
+		assert.Equal(t, hash("token"), key)
+
+		key, ok = TokenKey().Extract(req)
+		assert.True(t, ok)
+		assert.Equal(t, hash("sub:user-1"), key)
+
+		key, ok = HeaderKey("X-Tenant").Extract(req)
+		assert.True(t, ok)
+		assert.Equal(t, hash("acme"), key)
+
+		key, ok = QueryKey("client_id").Extract(req)
+		assert.True(t, ok)
+		assert.Equal(t, hash("abc"), key)
+
+		key, ok = RouteKey().Extract(req)
+		assert.True(t, ok)
+		assert.Equal(t, "/search", key)
+	})
+
+	t.Run("Missing sources", func(t *testing.T) {
+		anonymous := newKeyRequest("/search", &tokenpkg.Claims{IP: "198.51.100.1"})
+
+		for name, extractor := range map[string]KeyExtractor{
+			"sub":    SubjectKey(),
+			"header": HeaderKey("X-Tenant"),
+			"query":  QueryKey("client_id"),
+			"apikey": APIKey(),
+			"token":  TokenKey(),
+		} {
+			_, ok := extractor.Extract(anonymous)
+			assert.False(t, ok, name)
+		}
+
+		_, ok := IPKey().Extract(newKeyRequest("/", nil))
+		assert.False(t, ok)
+	})
+
+	t.Run("Composite replaces missing parts by the IP", func(t *testing.T) {
+		extractor, err := NewKeyExtractor("sub+route")
+		require.NoError(t, err)
+
+		key, ok := extractor.Extract(req)
+		assert.True(t, ok)
+		assert.Equal(t, hash("user-1")+"_/search", key)
+
+		key, ok = extractor.Extract(newKeyRequest("/search", &tokenpkg.Claims{IP: "198.51.100.1"}))
+		assert.True(t, ok)
+		assert.Equal(t, "198.51.100.1_/search", key)
+	})
+
+	t.Run("Route pattern", func(t *testing.T) {
+		var key string
+		router := chi.NewRouter()
+		router.Group(func(r chi.Router) {
+			r.Use(func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					key, _ = RouteKey().Extract(r)
+					next.ServeHTTP(w, r)
+				})
+			})
+			r.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+		})
+
+		router.ServeHTTP(httptest.NewRecorder(), newKeyRequest("/users/42", claims))
+		assert.Equal(t, "/users/{id}", key)
+	})
+
+	t.Run("Rejects unknown sources", func(t *testing.T) {
+		_, err := NewKeyExtractor("ip+cookie")
+		assert.ErrorContains(t, err, "unknown key source")
+	})
+}
@@ -2,32 +2,64 @@ package middlewarepkg
 
 import (
 	"context"
+	"errors"
+	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
 	confpkg "github.com/mayckol/rate-limiter/configpkg"
 	"github.com/mayckol/rate-limiter/internal/entity"
-	"github.com/mayckol/rate-limiter/utils"
+	"github.com/mayckol/rate-limiter/internal/infra/access"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/httppkg/clientip"
+	"github.com/mayckol/rate-limiter/internal/infra/logging"
+	"github.com/mayckol/rate-limiter/internal/infra/metrics"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"github.com/mayckol/rate-limiter/internal/infra/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/mayckol/rate-limiter/internal/tokenpkg"
 )
 
+// StatusClientClosedRequest answers the queued requests whose client went away before their turn, following nginx.
+const StatusClientClosedRequest = 499
+
 type MiddlewarePkg struct {
 	ReqRepository entity.RequestRepositoryInterface
+	// Policies hold the rules loaded from POLICY_FILE. Requests no rule matches, or every request when it holds none,
+	// are limited by the default policy.
+	Policies *policy.Holder
+	// Access holds the runtime entries of the allow and deny lists, merged with the ALLOWLIST and DENYLIST. Only the
+	// static lists are checked when it is nil.
+	Access *access.Store
+	// Metrics counts the decisions, if not nil.
+	Metrics *metrics.Metrics
+
+	// extractors caches the KeyExtractor of every policy key in use.
+	extractors sync.Map
 }
 
-func NewRateLimiterMiddleware(reqRepository entity.RequestRepositoryInterface) *MiddlewarePkg {
-	return &MiddlewarePkg{ReqRepository: reqRepository}
+func NewRateLimiterMiddleware(reqRepository entity.RequestRepositoryInterface, policies *policy.Holder, accessStore *access.Store, m *metrics.Metrics) *MiddlewarePkg {
+	return &MiddlewarePkg{ReqRepository: reqRepository, Policies: policies, Access: accessStore, Metrics: m}
 }
 
 // SetJWTClaimsMiddleware extracts the JWT token from the API_KEY header and sets the claims in the request context.
+// The claims IP is the client IP resolved behind the TRUSTED_PROXIES.
 func (m *MiddlewarePkg) SetJWTClaimsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spanCtx, span := tracing.Tracer().Start(r.Context(), "SetJWTClaimsMiddleware")
+		defer span.End()
+		r = r.WithContext(spanCtx)
+
 		authHeader := r.Header.Get("API_KEY")
-		duration := time.Duration(confpkg.Config.TokenExpiresInSec) * time.Second
+		span.SetAttributes(attribute.Bool("auth.token", authHeader != ""))
+		conf := confpkg.Current()
+		duration := time.Duration(conf.TokenExpiresInSec) * time.Second
 		claims := &tokenpkg.Claims{
-			IP:           r.RemoteAddr,
-			MaxReqPerSec: confpkg.Config.DefaultMaxReqPerSec,
+			IP:           clientip.For(conf.TrustedProxies).ClientIP(r),
+			MaxReqPerSec: conf.DefaultMaxReqPerSec,
 			RegisteredClaims: jwt.RegisteredClaims{
 				ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
 			},
@@ -44,11 +76,15 @@ func (m *MiddlewarePkg) SetJWTClaimsMiddleware(next http.Handler) http.Handler {
 			return tokenpkg.JwtKey(), nil
 		})
 		if err != nil || !t.Valid {
+			span.SetAttributes(attribute.Bool("auth.valid", false))
 			http.Error(w, "invalid token", http.StatusUnauthorized)
 			return
 		}
 
 		claims.MaxReqPerSec = tokenClaims.MaxReqPerSec
+		claims.Subject = tokenClaims.Subject
+		claims.ID = tokenClaims.ID
+		claims.BlockSec = tokenClaims.BlockSec
 		claims.ExpiresAt = tokenClaims.ExpiresAt
 
 		ctx := context.WithValue(r.Context(), "claims", claims)
@@ -56,30 +92,225 @@ func (m *MiddlewarePkg) SetJWTClaimsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// RateLimitMiddleware limits the number of requests per IP based on the maxReqPerSec in the JWT token.
-// This example uses an in-memory rate limiter for simplicity.
+// RateLimitMiddleware limits the requests matching a rule of the policy file by the rule's key. The other ones are
+// limited by RATE_LIMIT_KEY, per IP by default, to DEFAULT_MAX_REQ_PER_SEC, unless they carry a valid token: those are
+// limited by the token identity to the maxReqPerSec of the token, by the default key, or by both, according to
+// TOKEN_LIMIT_PRECEDENCE.
+// Clients on the allow lists bypass the limiter and the ones on the deny lists are refused with 403, by client IP or
+// token subject.
+// Every response carries the RateLimit headers describing the limiter state, and rejected ones also carry Retry-After.
+// When the limiter schedules the request in the future, it waits for its turn unless the client goes away first, in
+// which case the request is answered with StatusClientClosedRequest.
+// Every rejection is logged with the key and the limit that rejected it. While the cache backend fails, only the static
+// allow and deny lists apply and the requests are decided by the failure mode of their policy, the ones failing closed
+// being refused with 503.
 func (m *MiddlewarePkg) RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spanCtx, span := tracing.Tracer().Start(r.Context(), "RateLimitMiddleware")
+		defer span.End()
+		r = r.WithContext(spanCtx)
+
 		claims, ok := r.Context().Value("claims").(*tokenpkg.Claims)
 		if !ok {
 			http.Error(w, "unable to retrieve claims", http.StatusInternalServerError)
 			return
 		}
 
-		maxReqPerSec := claims.MaxReqPerSec
-		key := "rate_limiter_" + utils.ExtractNumbers(claims.IP)
+		logger := logging.FromContext(r.Context())
+		route := routePattern(r)
+		conf := confpkg.Current()
+		allow, deny := access.For(access.Allow, conf.Allowlist), access.For(access.Deny, conf.Denylist)
+		verdict, err := m.Access.Check(r.Context(), allow, deny, claims.IP, claims.Subject)
+		if err != nil {
+			// The runtime lists live in the cache backend too: while it fails, the static lists still apply and the
+			// failure mode of the policy decides the other requests.
+			logger.Warn("reading the runtime access lists failed, checking the static lists only", "error", err)
+			span.RecordError(err)
+			verdict = access.CheckStatic(allow, deny, claims.IP, claims.Subject)
+		}
+		switch verdict {
+		case access.Denied:
+			span.SetAttributes(attribute.String("ratelimit.policy", metrics.PolicyDenylist), attribute.Bool("ratelimit.allowed", false))
+			m.Metrics.Decision(metrics.PolicyDenylist, route, metrics.OutcomeRejected)
+			logger.Info("request rejected", "policy", metrics.PolicyDenylist, "ip", claims.IP, "subject", claims.Subject, "route", route)
+			http.Error(w, "access denied", http.StatusForbidden)
+			return
+		case access.Allowed:
+			span.SetAttributes(attribute.String("ratelimit.policy", metrics.PolicyAllowlist), attribute.Bool("ratelimit.allowed", true))
+			m.Metrics.Decision(metrics.PolicyAllowlist, route, metrics.OutcomeAllowed)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		checks, err := m.checks(r, claims)
+		if err != nil {
+			logger.Error("building the rate limit keys failed", "error", err)
+			tracing.Fail(span, err)
+			m.Metrics.Decision("", route, metrics.OutcomeError)
+			http.Error(w, "rate limiting error", http.StatusInternalServerError)
+			return
+		}
 
-		allowed, err := m.ReqRepository.CheckRateLimit(key, maxReqPerSec)
+		decision, key, err := m.check(r.Context(), checks)
 		if err != nil {
+			logger.Error("checking the rate limit failed", "key", key, "policy", checks[0].policy.Name, "error", err)
+			tracing.Fail(span, err)
+			m.Metrics.Decision(checks[0].policy.Name, route, metrics.OutcomeError)
+			if errors.Is(err, cache.ErrUnavailable) {
+				m.Metrics.Failure(checks[0].policy.Name, confpkg.FailureModeClosed)
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "rate limiter unavailable", http.StatusServiceUnavailable)
+				return
+			}
 			http.Error(w, "rate limiting error", http.StatusInternalServerError)
 			return
 		}
 
-		if !allowed {
+		span.SetAttributes(tracing.DecisionAttributes(decision)...)
+		if decision.FailureMode != "" {
+			m.Metrics.Failure(decision.Policy, decision.FailureMode)
+		}
+		if decision.FailureMode != confpkg.FailureModeOpen {
+			// Requests let through without a limiter have no limiter state to describe.
+			setRateLimitHeaders(w.Header(), decision)
+		}
+		if !decision.Allowed {
+			m.Metrics.Decision(decision.Policy, route, metrics.OutcomeRejected)
+			logRejection(logger, key, route, decision)
 			http.Error(w, "you have reached the maximum number of requests or actions allowed within a certain time frame", http.StatusTooManyRequests)
 			return
 		}
 
+		if wait := time.Until(decision.AdmitAt); wait > 0 {
+			span.SetAttributes(attribute.Float64("ratelimit.wait_seconds", wait.Seconds()))
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				m.Metrics.Decision(decision.Policy, route, metrics.OutcomeCanceled)
+				w.WriteHeader(StatusClientClosedRequest)
+				return
+			}
+		}
+
+		m.Metrics.Decision(decision.Policy, route, metrics.OutcomeAllowed)
 		next.ServeHTTP(w, r)
 	})
 }
+
+// routePattern returns the chi pattern of the route r matched, which keeps the cardinality of the route label bounded
+// unlike the path.
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		return rctx.RoutePattern()
+	}
+	return "unmatched"
+}
+
+// check is a limit a request is counted against.
+type check struct {
+	key    string
+	policy entity.Policy
+}
+
+// checks returns the limits r is counted against.
+func (m *MiddlewarePkg) checks(r *http.Request, claims *tokenpkg.Claims) ([]check, error) {
+	if rule, ok := m.Policies.Get().Match(r.Method, r.URL.Path); ok {
+		// Every rule counts separately from the other ones and from the default policy.
+		key, err := m.key(rule.Key, r)
+		return []check{{key: "rate_limiter_" + rule.Name + "_" + key, policy: rule.Policy()}}, err
+	}
+
+	conf := confpkg.Current()
+	key, err := m.key(conf.RateLimitKey, r)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := claims.Identity()
+	if identity == "" {
+		return []check{{key: "rate_limiter_" + key, policy: policy.Default(claims.MaxReqPerSec)}}, nil
+	}
+
+	token := check{key: "rate_limiter_token_" + hash(identity), policy: policy.Default(claims.MaxReqPerSec)}
+	if claims.BlockSec > 0 {
+		token.policy.Block = time.Duration(claims.BlockSec) * time.Second
+	}
+	fallback := check{key: "rate_limiter_" + key, policy: policy.Default(conf.DefaultMaxReqPerSec)}
+	switch conf.TokenLimitPrecedence {
+	case confpkg.TokenPrecedenceIP:
+		return []check{fallback}, nil
+	case confpkg.TokenPrecedenceToken:
+		return []check{token}, nil
+	default:
+		return []check{token, fallback}, nil
+	}
+}
+
+// logRejection logs the request rejected by decision for key.
+func logRejection(logger *slog.Logger, key, route string, decision *entity.Decision) {
+	attrs := []any{
+		"key", key,
+		"policy", decision.Policy,
+		"route", route,
+		"limit", decision.Limit,
+		"window", decision.Window,
+		"retry_after", decision.RetryAfter,
+	}
+	if decision.Ban != nil {
+		attrs = append(attrs, "ban_reason", decision.Ban.Reason, "ban_until", decision.Ban.Until)
+	}
+	logger.Info("request rejected", attrs...)
+}
+
+// check counts the request against every limit of checks, stopping at the first one rejecting it, and returns the
+// strictest decision along with the key it was taken for.
+func (m *MiddlewarePkg) check(ctx context.Context, checks []check) (*entity.Decision, string, error) {
+	var decision *entity.Decision
+	var key string
+	for _, c := range checks {
+		d, err := m.ReqRepository.CheckRateLimit(ctx, c.key, c.policy)
+		if err != nil {
+			return nil, c.key, err
+		}
+		if !d.Allowed {
+			return d, c.key, nil
+		}
+		if decision == nil {
+			decision, key = d, c.key
+			continue
+		}
+
+		admitAt := decision.AdmitAt
+		if d.AdmitAt.After(admitAt) {
+			admitAt = d.AdmitAt
+		}
+		if d.Remaining < decision.Remaining {
+			decision, key = d, c.key
+		}
+		merged := *decision
+		merged.AdmitAt = admitAt
+		decision = &merged
+	}
+	return decision, key, nil
+}
+
+// key extracts the key part of r with the extractor of source, falling back to the client IP when r lacks it.
+func (m *MiddlewarePkg) key(source string, r *http.Request) (string, error) {
+	extractor, ok := m.extractors.Load(source)
+	if !ok {
+		e, err := NewKeyExtractor(source)
+		if err != nil {
+			return "", err
+		}
+		extractor, _ = m.extractors.LoadOrStore(source, e)
+	}
+
+	if key, ok := extractor.(KeyExtractor).Extract(r); ok {
+		return key, nil
+	}
+	key, _ := IPKey().Extract(r)
+	return key, nil
+}
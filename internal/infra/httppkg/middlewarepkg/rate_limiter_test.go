@@ -1,26 +1,49 @@
 package middlewarepkg
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
 	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/access"
+	"github.com/mayckol/rate-limiter/internal/infra/breaker"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"github.com/mayckol/rate-limiter/internal/infra/logging"
+	"github.com/mayckol/rate-limiter/internal/infra/metrics"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"github.com/mayckol/rate-limiter/internal/infra/repository"
 	"github.com/mayckol/rate-limiter/internal/tokenpkg"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type MockRequestRepository struct {
 	mock.Mock
 }
 
-func (m *MockRequestRepository) CheckRateLimit(key string, maxReqPerSec int) (bool, error) {
-	args := m.Called(key, maxReqPerSec)
-	return args.Bool(0), args.Error(1)
+func (m *MockRequestRepository) CheckRateLimit(ctx context.Context, key string, p entity.Policy) (*entity.Decision, error) {
+	args := m.Called(ctx, key, p)
+	decision, _ := args.Get(0).(*entity.Decision)
+	return decision, args.Error(1)
 }
 
 func validToken() string {
@@ -49,9 +72,23 @@ func expiredToken() string {
 	return tokenString
 }
 
+// withConf activates a copy of the current configuration, changed by change when not nil, until the end of the test.
+// The returned configuration is the active one, so that the test can keep changing it.
+func withConf(t *testing.T, change func(conf *confpkg.Conf)) *confpkg.Conf {
+	t.Helper()
+	previous := confpkg.Current()
+	conf := *previous
+	if change != nil {
+		change(&conf)
+	}
+	confpkg.Activate(&conf)
+	t.Cleanup(func() { confpkg.Activate(previous) })
+	return &conf
+}
+
 func TestNewRateLimiterMiddleware(t *testing.T) {
 	mockRepo := new(MockRequestRepository)
-	middleware := NewRateLimiterMiddleware(mockRepo)
+	middleware := NewRateLimiterMiddleware(mockRepo, nil, nil, nil)
 	assert.NotNil(t, middleware)
 }
 func TestSetJWTClaimsMiddleware(t *testing.T) {
@@ -80,13 +117,41 @@ func TestSetJWTClaimsMiddleware(t *testing.T) {
 		handler := middleware.SetJWTClaimsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			claims, ok := r.Context().Value("claims").(*tokenpkg.Claims)
 			assert.True(t, ok)
-			assert.Equal(t, confpkg.Config.DefaultMaxReqPerSec, claims.MaxReqPerSec)
+			assert.Equal(t, confpkg.Current().DefaultMaxReqPerSec, claims.MaxReqPerSec)
 		}))
 
 		handler.ServeHTTP(rr, req)
 		assert.Equal(t, http.StatusOK, rr.Code)
 	})
 
+	t.Run("Client IP behind a trusted proxy", func(t *testing.T) {
+		withConf(t, func(conf *confpkg.Conf) {
+			conf.TrustedProxies = "10.0.0.0/8"
+		})
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:4000"
+		req.Header.Set("X-Forwarded-For", "1.1.1.1, 198.51.100.1")
+		rr := httptest.NewRecorder()
+
+		middleware := &MiddlewarePkg{}
+		handler := middleware.SetJWTClaimsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value("claims").(*tokenpkg.Claims)
+			assert.True(t, ok)
+			assert.Equal(t, "198.51.100.1", claims.IP)
+		}))
+
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		req.RemoteAddr = "203.0.113.7:4000"
+		handler = middleware.SetJWTClaimsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, _ := r.Context().Value("claims").(*tokenpkg.Claims)
+			assert.Equal(t, "203.0.113.7", claims.IP)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	})
+
 	t.Run("Invalid token", func(t *testing.T) {
 		req, _ := http.NewRequest("GET", "/", nil)
 		req.Header.Set("API_KEY", "invalid_token")
@@ -121,7 +186,7 @@ func TestSetJWTClaimsMiddleware(t *testing.T) {
 		rr := httptest.NewRecorder()
 
 		mockRepo := new(MockRequestRepository)
-		mockRepo.On("CheckRateLimit", "rate_limiter_", 10).Return(false, assert.AnError)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_", policy.Default(10)).Return(nil, assert.AnError)
 
 		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
 		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
@@ -140,7 +205,7 @@ func TestSetJWTClaimsMiddleware(t *testing.T) {
 		rr := httptest.NewRecorder()
 
 		mockRepo := new(MockRequestRepository)
-		mockRepo.On("CheckRateLimit", "rate_limiter_127001", 10).Return(true, nil)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(10)).Return(&entity.Decision{Allowed: true}, nil)
 
 		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
 		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -162,7 +227,7 @@ func TestSetJWTClaimsMiddleware(t *testing.T) {
 		rr := httptest.NewRecorder()
 
 		mockRepo := new(MockRequestRepository)
-		mockRepo.On("CheckRateLimit", "rate_limiter_127001", 10).Return(false, nil)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(10)).Return(&entity.Decision{Allowed: false}, nil)
 
 		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
 		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
@@ -182,7 +247,7 @@ func TestSetJWTClaimsMiddleware(t *testing.T) {
 		rr := httptest.NewRecorder()
 
 		mockRepo := new(MockRequestRepository)
-		mockRepo.On("CheckRateLimit", "rate_limiter_127001", 10).Return(false, assert.AnError)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(10)).Return(nil, assert.AnError)
 
 		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
 		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
@@ -191,4 +256,554 @@ func TestSetJWTClaimsMiddleware(t *testing.T) {
 		assert.Equal(t, http.StatusInternalServerError, rr.Code)
 		mockRepo.AssertExpectations(t)
 	})
+
+	t.Run("Queued request waits until it is admitted", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		ctx := context.WithValue(req.Context(), "claims", &tokenpkg.Claims{
+			IP:           "127.0.0.1",
+			MaxReqPerSec: 10,
+		})
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		admitAt := time.Now().Add(50 * time.Millisecond)
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(10)).Return(&entity.Decision{Allowed: true, AdmitAt: admitAt}, nil)
+
+		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
+		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.False(t, time.Now().Before(admitAt))
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Queued request is rejected when the queue is full", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		ctx := context.WithValue(req.Context(), "claims", &tokenpkg.Claims{
+			IP:           "127.0.0.1",
+			MaxReqPerSec: 10,
+		})
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(10)).Return(&entity.Decision{Allowed: false}, nil)
+
+		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
+		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Fatal("handler must not be called")
+		}))
+
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Queued request stops waiting when the client goes away", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		ctx, cancel := context.WithCancel(context.WithValue(req.Context(), "claims", &tokenpkg.Claims{
+			IP:           "127.0.0.1",
+			MaxReqPerSec: 10,
+		}))
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(10)).Return(&entity.Decision{Allowed: true, AdmitAt: time.Now().Add(time.Minute)}, nil)
+
+		stats := metrics.New()
+		middleware := &MiddlewarePkg{ReqRepository: mockRepo, Metrics: stats}
+		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Fatal("handler must not be called")
+		}))
+
+		time.AfterFunc(20*time.Millisecond, cancel)
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, StatusClientClosedRequest, rr.Code)
+		mockRepo.AssertExpectations(t)
+
+		exposition := httptest.NewRecorder()
+		stats.Handler().ServeHTTP(exposition, httptest.NewRequest("GET", "/metrics", nil))
+		assert.Contains(t, exposition.Body.String(), `ratelimiter_decisions_total{outcome="canceled",policy="",route="unmatched"} 1`)
+		assert.NotContains(t, exposition.Body.String(), `outcome="allowed"`)
+	})
+
+	t.Run("Rate limit middleware sets the RateLimit headers", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		ctx := context.WithValue(req.Context(), "claims", &tokenpkg.Claims{
+			IP:           "127.0.0.1",
+			MaxReqPerSec: 10,
+		})
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(10)).Return(&entity.Decision{
+			Allowed:   true,
+			Limit:     10,
+			Window:    time.Second,
+			Remaining: 7,
+			ResetAt:   time.Now().Add(800 * time.Millisecond),
+		}, nil)
+
+		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
+		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "10", rr.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "7", rr.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "1", rr.Header().Get("RateLimit-Reset"))
+		assert.Equal(t, "10;w=1", rr.Header().Get("RateLimit-Policy"))
+		assert.Empty(t, rr.Header().Get("Retry-After"))
+		assert.Empty(t, rr.Header().Get("X-RateLimit-Limit"))
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Rate limit middleware groups IPv6 clients by prefix", func(t *testing.T) {
+		withConf(t, func(conf *confpkg.Conf) {
+			conf.IPv6PrefixLength = 64
+		})
+
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_2001:db8:1:2::/64", policy.Default(10)).Return(&entity.Decision{Allowed: true}, nil).Twice()
+
+		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
+		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		for _, ip := range []string{"[2001:db8:1:2::1]:4000", "2001:db8:1:2:ffff::9"} {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), "claims", &tokenpkg.Claims{IP: ip, MaxReqPerSec: 10}))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Rate limit middleware keys the default policy by RATE_LIMIT_KEY", func(t *testing.T) {
+		withConf(t, func(conf *confpkg.Conf) {
+			conf.RateLimitKey = "api_key"
+		})
+
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_"+hash("token 1"), policy.Default(10)).Return(&entity.Decision{Allowed: true}, nil).Once()
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(10)).Return(&entity.Decision{Allowed: true}, nil).Once()
+
+		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
+		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		for _, token := range []string{"token 1", ""} {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Header.Set("API_KEY", token)
+			req = req.WithContext(context.WithValue(req.Context(), "claims", &tokenpkg.Claims{IP: "127.0.0.1", MaxReqPerSec: 10}))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Rate limit middleware sets Retry-After and legacy headers on rejection", func(t *testing.T) {
+		withConf(t, func(conf *confpkg.Conf) {
+			conf.RateLimitLegacyHeaders = true
+		})
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		ctx := context.WithValue(req.Context(), "claims", &tokenpkg.Claims{
+			IP:           "127.0.0.1",
+			MaxReqPerSec: 10,
+		})
+		req = req.WithContext(ctx)
+		rr := httptest.NewRecorder()
+
+		resetAt := time.Now().Add(10 * time.Second)
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(10)).Return(&entity.Decision{
+			Allowed:    false,
+			Limit:      10,
+			Window:     time.Second,
+			Remaining:  0,
+			ResetAt:    resetAt,
+			RetryAfter: 2500 * time.Millisecond,
+		}, nil)
+
+		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
+		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.Equal(t, "3", rr.Header().Get("Retry-After"))
+		assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "10", rr.Header().Get("X-RateLimit-Limit"))
+		assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"))
+		assert.Equal(t, strconv.FormatInt(resetAt.Unix(), 10), rr.Header().Get("X-RateLimit-Reset"))
+		mockRepo.AssertExpectations(t)
+	})
+}
+
+func TestRateLimitMiddlewarePolicies(t *testing.T) {
+	confpkg.LoadConfig(true)
+
+	rules, err := policy.NewSet([]policy.Rule{
+		{Name: "login", Path: "/login", Methods: []string{"POST"}, Limit: 5, Window: policy.Duration(time.Minute)},
+		{Name: "search", Path: "/search/**", Key: "header:X-Api-Key", Algorithm: "token_bucket", Limit: 100, Window: policy.Duration(time.Second)},
+	})
+	assert.NoError(t, err)
+	policies := policy.NewHolder(rules)
+
+	newRequest := func(method, target string) *http.Request {
+		req, _ := http.NewRequest(method, target, nil)
+		ctx := context.WithValue(req.Context(), "claims", &tokenpkg.Claims{
+			IP:           "127.0.0.1",
+			MaxReqPerSec: 10,
+		})
+		return req.WithContext(ctx)
+	}
+
+	serve := func(mockRepo *MockRequestRepository, req *http.Request) {
+		middleware := NewRateLimiterMiddleware(mockRepo, policies, nil, nil)
+		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		mockRepo.AssertExpectations(t)
+	}
+
+	t.Run("Applies the matching rule", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_login_127.0.0.1", entity.Policy{
+			Name:        "login",
+			Algorithm:   limiter.AlgorithmFixedWindow,
+			Limit:       5,
+			Window:      time.Minute,
+			FailureMode: confpkg.FailureModeClosed,
+		}).Return(&entity.Decision{Allowed: true}, nil)
+
+		serve(mockRepo, newRequest(http.MethodPost, "/login"))
+	})
+
+	t.Run("Falls back to the default policy when the method does not match", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(10)).Return(&entity.Decision{Allowed: true}, nil)
+
+		serve(mockRepo, newRequest(http.MethodGet, "/login"))
+	})
+
+	t.Run("Keys the request by the rule header", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, mock.MatchedBy(func(key string) bool {
+			return strings.HasPrefix(key, "rate_limiter_search_h") && len(key) == len("rate_limiter_search_h")+32
+		}), mock.MatchedBy(func(p entity.Policy) bool {
+			return p.Name == "search" && p.Algorithm == "token_bucket" && p.Limit == 100
+		})).Return(&entity.Decision{Allowed: true}, nil)
+
+		req := newRequest(http.MethodGet, "/search/users")
+		req.Header.Set("X-Api-Key", "key 1")
+		serve(mockRepo, req)
+	})
+
+	t.Run("Keys the request by IP when the rule header is missing", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_search_127.0.0.1", mock.Anything).Return(&entity.Decision{Allowed: true}, nil)
+
+		serve(mockRepo, newRequest(http.MethodGet, "/search"))
+	})
+
+	t.Run("Applies the rules stored after a reload", func(t *testing.T) {
+		reloaded, err := policy.NewSet([]policy.Rule{
+			{Name: "reloaded", Path: "/login", Limit: 1, Window: policy.Duration(time.Second)},
+		})
+		assert.NoError(t, err)
+		holder := policy.NewHolder(rules)
+		holder.Store(reloaded)
+
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_reloaded_127.0.0.1", mock.Anything).Return(&entity.Decision{Allowed: true}, nil)
+
+		middleware := NewRateLimiterMiddleware(mockRepo, holder, nil, nil)
+		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest(http.MethodPost, "/login"))
+		mockRepo.AssertExpectations(t)
+	})
+}
+
+func TestRateLimitMiddlewareTokens(t *testing.T) {
+	confpkg.LoadConfig(true)
+	defaultLimit := confpkg.Current().DefaultMaxReqPerSec
+
+	claims := &tokenpkg.Claims{IP: "127.0.0.1", MaxReqPerSec: 50, RegisteredClaims: jwt.RegisteredClaims{ID: "id"}}
+	tokenKey := "rate_limiter_token_" + hash("jti:id")
+
+	serve := func(t *testing.T, precedence string, mockRepo *MockRequestRepository) *httptest.ResponseRecorder {
+		withConf(t, func(conf *confpkg.Conf) {
+			conf.TokenLimitPrecedence = precedence
+		})
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "claims", claims))
+		rr := httptest.NewRecorder()
+
+		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
+		handler := middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		handler.ServeHTTP(rr, req)
+		mockRepo.AssertExpectations(t)
+		return rr
+	}
+
+	t.Run("Counts the token identity with the token limit only when the token takes precedence", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, tokenKey, policy.Default(50)).Return(&entity.Decision{Allowed: true}, nil)
+
+		rr := serve(t, confpkg.TokenPrecedenceToken, mockRepo)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("Counts the IP with the default limit when the IP takes precedence", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(defaultLimit)).Return(&entity.Decision{Allowed: true}, nil)
+
+		rr := serve(t, confpkg.TokenPrecedenceIP, mockRepo)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("Counts both and reports the strictest decision", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, tokenKey, policy.Default(50)).Return(&entity.Decision{Allowed: true, Limit: 50, Remaining: 40, Window: time.Second}, nil)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(defaultLimit)).Return(&entity.Decision{Allowed: true, Limit: 10, Remaining: 2, Window: time.Second}, nil)
+
+		rr := serve(t, "", mockRepo)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "10", rr.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "2", rr.Header().Get("RateLimit-Remaining"))
+	})
+
+	t.Run("Bans the token identity for the duration of its claim", func(t *testing.T) {
+		blocked := *claims
+		blocked.BlockSec = 30
+		p := policy.Default(50)
+		p.Block = 30 * time.Second
+
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, tokenKey, p).Return(&entity.Decision{Allowed: true}, nil)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", policy.Default(defaultLimit)).Return(&entity.Decision{Allowed: true}, nil)
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "claims", &blocked))
+		middleware := &MiddlewarePkg{ReqRepository: mockRepo}
+		middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), req)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Stops at the first limit rejecting the request", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, tokenKey, policy.Default(50)).Return(&entity.Decision{Allowed: false, Limit: 50}, nil)
+
+		rr := serve(t, confpkg.TokenPrecedenceBoth, mockRepo)
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		mockRepo.AssertNotCalled(t, "CheckRateLimit", mock.Anything, "rate_limiter_127.0.0.1", mock.Anything)
+	})
+}
+
+func TestRateLimitMiddlewareAccess(t *testing.T) {
+	confpkg.LoadConfig(true)
+	withConf(t, func(conf *confpkg.Conf) {
+		conf.Allowlist = "10.0.0.0/8, sub:health"
+		conf.Denylist = "10.6.6.6"
+	})
+
+	client, err := memory.NewMemoryClient(&memory.ClientSettings{})
+	require.NoError(t, err)
+	defer client.Close()
+	store := access.NewStore(client)
+	_, err = store.Add(context.Background(), access.Deny, "sub:abuser", 0)
+	require.NoError(t, err)
+
+	serve := func(claims *tokenpkg.Claims, mockRepo *MockRequestRepository) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "claims", claims))
+		rr := httptest.NewRecorder()
+
+		middleware := NewRateLimiterMiddleware(mockRepo, nil, store, nil)
+		middleware.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Lets allowed clients bypass the limiter", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+
+		rr := serve(&tokenpkg.Claims{IP: "10.1.2.3", MaxReqPerSec: 10}, mockRepo)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Empty(t, rr.Header().Get("RateLimit-Policy"))
+		rr = serve(&tokenpkg.Claims{IP: "203.0.113.1", MaxReqPerSec: 10, RegisteredClaims: jwt.RegisteredClaims{Subject: "health"}}, mockRepo)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockRepo.AssertNotCalled(t, "CheckRateLimit", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Refuses denied clients", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+
+		rr := serve(&tokenpkg.Claims{IP: "10.6.6.6", MaxReqPerSec: 10}, mockRepo)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		rr = serve(&tokenpkg.Claims{IP: "10.1.2.3", MaxReqPerSec: 10, RegisteredClaims: jwt.RegisteredClaims{Subject: "abuser"}}, mockRepo)
+		assert.Equal(t, http.StatusForbidden, rr.Code, "runtime entries are checked")
+		mockRepo.AssertNotCalled(t, "CheckRateLimit", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Limits the other clients", func(t *testing.T) {
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_203.0.113.1", policy.Default(10)).Return(&entity.Decision{Allowed: true}, nil)
+
+		rr := serve(&tokenpkg.Claims{IP: "203.0.113.1", MaxReqPerSec: 10}, mockRepo)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockRepo.AssertExpectations(t)
+	})
+}
+
+func TestRateLimitMiddlewareMetrics(t *testing.T) {
+	confpkg.LoadConfig(true)
+	stats := metrics.New()
+	mockRepo := new(MockRequestRepository)
+	mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_192.0.2.1", mock.Anything).Return(&entity.Decision{Allowed: true, Policy: policy.DefaultName}, nil).Once()
+	mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_192.0.2.1", mock.Anything).Return(&entity.Decision{Allowed: false, Policy: policy.DefaultName}, nil).Once()
+	mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_192.0.2.1", mock.Anything).Return(nil, assert.AnError)
+
+	m := NewRateLimiterMiddleware(mockRepo, nil, nil, stats)
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(m.SetJWTClaimsMiddleware, m.RateLimitMiddleware)
+		r.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	})
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/items/"+strconv.Itoa(i), nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rr := httptest.NewRecorder()
+	stats.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	for _, outcome := range []string{metrics.OutcomeAllowed, metrics.OutcomeRejected, metrics.OutcomeError} {
+		assert.Contains(t, rr.Body.String(), `ratelimiter_decisions_total{outcome="`+outcome+`",policy="default",route="/items/{id}"} 1`)
+	}
+}
+
+func TestRateLimitMiddlewareTracing(t *testing.T) {
+	confpkg.LoadConfig(true)
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	mockRepo := new(MockRequestRepository)
+	mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_192.0.2.1", mock.Anything).Return(&entity.Decision{Allowed: true, Limit: 3, Remaining: 2, Policy: policy.DefaultName}, nil)
+	m := NewRateLimiterMiddleware(mockRepo, nil, nil, nil)
+	handler := m.SetJWTClaimsMiddleware(m.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	limit, claims := spans[0], spans[1]
+	assert.Equal(t, "RateLimitMiddleware", limit.Name())
+	assert.Equal(t, "SetJWTClaimsMiddleware", claims.Name())
+	assert.Equal(t, claims.SpanContext().SpanID(), limit.Parent().SpanID())
+	assert.Contains(t, limit.Attributes(), attribute.Bool("ratelimit.allowed", true))
+	assert.Contains(t, limit.Attributes(), attribute.Int("ratelimit.remaining", 2))
+}
+
+func TestRateLimitMiddlewareLogsRejections(t *testing.T) {
+	confpkg.LoadConfig(true)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	mockRepo := new(MockRequestRepository)
+	mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_192.0.2.1", mock.Anything).Return(&entity.Decision{Allowed: false, Limit: 3, Window: time.Second, RetryAfter: 2 * time.Second, Policy: policy.DefaultName}, nil)
+	m := NewRateLimiterMiddleware(mockRepo, nil, nil, nil)
+	handler := m.SetJWTClaimsMiddleware(m.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req.WithContext(logging.WithLogger(req.Context(), logger)))
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "request rejected", line["msg"])
+	assert.Equal(t, "rate_limiter_192.0.2.1", line["key"])
+	assert.Equal(t, policy.DefaultName, line["policy"])
+	assert.Equal(t, float64(3), line["limit"])
+	assert.Equal(t, float64(2*time.Second), line["retry_after"])
+}
+
+func TestRateLimitMiddlewareFailureModes(t *testing.T) {
+	confpkg.LoadConfig(true)
+	serve := func(decision *entity.Decision, err error) *httptest.ResponseRecorder {
+		mockRepo := new(MockRequestRepository)
+		mockRepo.On("CheckRateLimit", mock.Anything, "rate_limiter_192.0.2.1", mock.Anything).Return(decision, err)
+		m := NewRateLimiterMiddleware(mockRepo, nil, nil, nil)
+		handler := m.SetJWTClaimsMiddleware(m.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(nil, fmt.Errorf("%w: connection refused", cache.ErrUnavailable))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+
+	rr = serve(nil, assert.AnError)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	rr = serve(&entity.Decision{Allowed: true, Limit: 10, Remaining: 10, Policy: policy.DefaultName, FailureMode: confpkg.FailureModeOpen}, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("RateLimit-Limit"), "no limiter state to describe")
+
+	rr = serve(&entity.Decision{Allowed: true, Limit: 5, Remaining: 4, Policy: policy.DefaultName, FailureMode: confpkg.FailureModeLocal}, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "5", rr.Header().Get("RateLimit-Limit"))
+}
+
+func TestRateLimitMiddlewareCacheOutage(t *testing.T) {
+	_, _, err := confpkg.LoadConfig(true)
+	require.NoError(t, err)
+	conf := withConf(t, nil)
+
+	// The breaker is open, as while the backend is down, so the guarded client refuses every operation.
+	down := breaker.New(breaker.Settings{Failures: 1, Cooldown: time.Hour})
+	done, err := down.Allow()
+	require.NoError(t, err)
+	done(breaker.Failure)
+	mem, err := memory.NewMemoryClient(&memory.ClientSettings{})
+	require.NoError(t, err)
+	defer mem.Close()
+	client := cache.Guard(mem, down, 0)
+	local, err := memory.NewMemoryClient(&memory.ClientSettings{})
+	require.NoError(t, err)
+	defer local.Close()
+
+	repo := repository.NewFailoverRepository(
+		repository.NewRequestRepository(client, limiter.NewFixedWindow(client)),
+		repository.NewRequestRepository(local, limiter.NewFixedWindow(local)),
+	)
+	m := NewRateLimiterMiddleware(repo, nil, access.NewStore(client), nil)
+	handler := m.SetJWTClaimsMiddleware(m.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	serve := func(failureMode, ip string) int {
+		conf.FailureMode = failureMode
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(confpkg.FailureModeOpen, "192.0.2.1"))
+	assert.Equal(t, http.StatusOK, serve(confpkg.FailureModeLocal, "192.0.2.1"))
+	assert.Equal(t, http.StatusServiceUnavailable, serve(confpkg.FailureModeClosed, "192.0.2.1"))
+
+	conf.Denylist = "203.0.113.0/24"
+	assert.Equal(t, http.StatusForbidden, serve(confpkg.FailureModeOpen, "203.0.113.7"), "the static lists still apply")
 }
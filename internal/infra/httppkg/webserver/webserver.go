@@ -3,49 +3,56 @@ package webserver
 import (
 	"context"
 	"errors"
-	"fmt"
 	confpkg "github.com/mayckol/rate-limiter/configpkg"
 	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/access"
 	"github.com/mayckol/rate-limiter/internal/infra/httppkg/handlers"
-	"log"
+	"github.com/mayckol/rate-limiter/internal/infra/metrics"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"log/slog"
 	"net/http"
-	"os"
 	"os/signal"
 	"syscall"
 	"time"
 )
 
-func Start(reqRepository entity.RequestRepositoryInterface) {
-	server := &http.Server{Addr: confpkg.Config.WSHost, Handler: handlers.Handler(reqRepository)}
+// shutdownTimeout is how long the requests in flight are waited for on shutdown before their connections are closed.
+const shutdownTimeout = 30 * time.Second
+
+// Start serves the routes until SIGINT, SIGTERM or SIGQUIT, then waits for the requests in flight. SIGHUP is left to
+// the configuration reloader. It returns the error that stopped the server, if any.
+func Start(reqRepository entity.RequestRepositoryInterface, adminRepository entity.AdminRepositoryInterface, policies *policy.Holder, accessStore *access.Store, stats *metrics.Metrics, logger *slog.Logger) error {
+	addr := confpkg.Current().WSHost
+	server := &http.Server{
+		Addr:     addr,
+		Handler:  handlers.Handler(reqRepository, adminRepository, policies, accessStore, stats, logger),
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
 
-	serverCtx, serverStopCtx := context.WithCancel(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	serveErr := make(chan error, 1)
 	go func() {
-		<-sig
-
-		shutdownCtx, _ := context.WithTimeout(serverCtx, 30*time.Second)
-
-		go func() {
-			<-shutdownCtx.Done()
-			if errors.Is(shutdownCtx.Err(), context.DeadlineExceeded) {
-				log.Fatal("graceful shutdown timed out.. forcing exit.")
-			}
-		}()
-
-		err := server.Shutdown(shutdownCtx)
-		if err != nil {
-			log.Fatal(err)
-		}
-		serverStopCtx()
+		logger.Info("starting server", "addr", addr)
+		serveErr <- server.ListenAndServe()
 	}()
 
-	fmt.Printf("starting server on %s\n", confpkg.Config.WSHost)
-	err := server.ListenAndServe()
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatal(err)
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
 	}
 
-	<-serverCtx.Done()
+	logger.Info("shutting down the server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Error("graceful shutdown timed out, closing the remaining connections")
+			return server.Close()
+		}
+		return err
+	}
+	return nil
 }
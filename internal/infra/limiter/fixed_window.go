@@ -0,0 +1,90 @@
+package limiter
+
+import (
+	"context"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"time"
+)
+
+// fixedWindowScript increments the counter stored at KEYS[1] only while it is below the limit, so the check and the
+// increment happen atomically on the server. Rejected requests leave the counter and its expiration untouched.
+// ARGV[1] is the limit, ARGV[2] the window in milliseconds and ARGV[3] is 1 to compute the result without counting the
+// request.
+var fixedWindowScript = cache.NewScript(`
+local limit = tonumber(ARGV[1])
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+
+if current < limit then
+	if ARGV[3] == '1' then
+		local ttl = redis.call('PTTL', KEYS[1])
+		if ttl < 0 then
+			ttl = tonumber(ARGV[2])
+		end
+		return {1, limit - current - 1, ttl, 0}
+	end
+	current = redis.call('INCR', KEYS[1])
+	if current == 1 then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	end
+	return {1, limit - current, redis.call('PTTL', KEYS[1]), 0}
+end
+
+local ttl = math.max(redis.call('PTTL', KEYS[1]), 0)
+return {0, 0, ttl, ttl}
+`)
+
+// FixedWindow counts requests in windows of limit.Period, rejecting the ones over limit.Rate until the window ends.
+type FixedWindow struct {
+	client cache.ClientInterface
+	now    func() time.Time
+}
+
+func NewFixedWindow(client cache.ClientInterface) *FixedWindow {
+	return &FixedWindow{client: client, now: time.Now}
+}
+
+func (f *FixedWindow) Allow(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return f.check(ctx, key, limit, false)
+}
+
+func (f *FixedWindow) Peek(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return f.check(ctx, key, limit, true)
+}
+
+func (f *FixedWindow) Reset(ctx context.Context, key string, limit Limit) error {
+	return f.client.Delete(ctx, key)
+}
+
+func (f *FixedWindow) check(ctx context.Context, key string, limit Limit, dry bool) (*Result, error) {
+	if scripter, ok := f.client.(cache.Scripter); ok {
+		return newResult(scripter.RunScript(ctx, fixedWindowScript, []string{key}, limit.Rate, limit.Period.Milliseconds(), dryRun(dry)))
+	}
+
+	return run(ctx, f.client, key, f.step(limit), dry)
+}
+
+// step keeps the counter along with the time its window ends.
+func (f *FixedWindow) step(limit Limit) stepFunc {
+	now := f.now()
+	return func(value string, found bool) (string, time.Duration, bool, *Result) {
+		count, resetAt := 0.0, now.Add(limit.Period)
+		if state, ok := decodeState(value, 2); found && ok && time.UnixMilli(int64(state[1])).After(now) {
+			count, resetAt = state[0], time.UnixMilli(int64(state[1]))
+		}
+
+		ttl := resetAt.Sub(now)
+		if int(count) >= limit.Rate {
+			return value, ttl, false, &Result{
+				ResetAfter: ttl,
+				RetryAfter: ttl,
+			}
+		}
+
+		count++
+		return encodeState(count, float64(resetAt.UnixMilli())), ttl, true, &Result{
+			Allowed:    true,
+			Remaining:  limit.Rate - int(count),
+			ResetAfter: ttl,
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package limiter
+
+import (
+	"context"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"math"
+	"time"
+)
+
+// gcraScript implements the generic cell rate algorithm. The only state is the theoretical arrival time (TAT) of the
+// next request stored at KEYS[1]; a request is allowed when it does not arrive earlier than the TAT minus the burst
+// tolerance. ARGV[1] is the emission interval, ARGV[2] the burst tolerance and ARGV[3] the current time, all in
+// milliseconds, and ARGV[4] is 1 to compute the result without counting the request.
+var gcraScript = cache.NewScript(`
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local tat = math.max(tonumber(redis.call('GET', KEYS[1])) or now, now)
+local new_tat = tat + interval
+local diff = now - (new_tat - tolerance)
+
+if diff < 0 then
+	return {0, 0, math.ceil(tat - now), math.ceil(-diff)}
+end
+
+local reset_after = math.ceil(new_tat - now)
+if ARGV[4] ~= '1' then
+	redis.call('SET', KEYS[1], string.format('%.3f', new_tat), 'PX', reset_after)
+end
+return {1, math.floor(diff / interval), reset_after, 0}
+`)
+
+// GCRA spaces requests evenly at one every limit.Period / limit.Rate while tolerating bursts of up to
+// limit.Rate + limit.Burst requests. It stores a single value per key and computes exact retry and reset times.
+type GCRA struct {
+	client cache.ClientInterface
+	now    func() time.Time
+}
+
+func NewGCRA(client cache.ClientInterface) *GCRA {
+	return &GCRA{client: client, now: time.Now}
+}
+
+func (g *GCRA) Allow(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return g.check(ctx, key, limit, false)
+}
+
+func (g *GCRA) Peek(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return g.check(ctx, key, limit, true)
+}
+
+func (g *GCRA) Reset(ctx context.Context, key string, limit Limit) error {
+	return g.client.Delete(ctx, key+":"+AlgorithmGCRA)
+}
+
+func (g *GCRA) check(ctx context.Context, key string, limit Limit, dry bool) (*Result, error) {
+	capacity := limit.Rate + limit.Burst
+	if limit.Rate <= 0 || capacity <= 0 {
+		return &Result{Allowed: false, RetryAfter: limit.Period, ResetAfter: limit.Period}, nil
+	}
+
+	interval := float64(limit.Period.Milliseconds()) / float64(limit.Rate)
+	tolerance := interval * float64(capacity)
+	now := g.now().UnixMilli()
+	key = key + ":" + AlgorithmGCRA
+
+	if scripter, ok := g.client.(cache.Scripter); ok {
+		return newResult(scripter.RunScript(ctx, gcraScript, []string{key}, interval, tolerance, now, dryRun(dry)))
+	}
+
+	return run(ctx, g.client, key, g.step(interval, tolerance, float64(now)), dry)
+}
+
+// step keeps the theoretical arrival time in milliseconds.
+func (g *GCRA) step(interval, tolerance, now float64) stepFunc {
+	return func(value string, found bool) (string, time.Duration, bool, *Result) {
+		tat := now
+		if state, ok := decodeState(value, 1); found && ok {
+			tat = math.Max(state[0], now)
+		}
+
+		newTAT := tat + interval
+		diff := now - (newTAT - tolerance)
+		if diff < 0 {
+			return "", 0, false, &Result{
+				ResetAfter: millis(tat - now),
+				RetryAfter: millis(-diff),
+			}
+		}
+
+		resetAfter := millis(newTAT - now)
+		return encodeState(newTAT), resetAfter, true, &Result{
+			Allowed:    true,
+			Remaining:  int(math.Floor(diff / interval)),
+			ResetAfter: resetAfter,
+		}
+	}
+}
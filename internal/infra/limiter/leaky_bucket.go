@@ -0,0 +1,121 @@
+package limiter
+
+import (
+	"context"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"math"
+	"time"
+)
+
+// leakyBucketScript schedules requests to leave the bucket one every interval. KEYS[1] stores the time the last queued
+// request is scheduled at, so a new request is admitted at that time plus the interval, or right away when the bucket
+// is empty. Requests that would wait longer than the maximum wait or find the queue full are rejected without being
+// scheduled. ARGV[1] is the interval, ARGV[2] the queue size, ARGV[3] the maximum wait and ARGV[4] the current time,
+// durations being in milliseconds, and ARGV[5] is 1 to compute the result without scheduling the request.
+var leakyBucketScript = cache.NewScript(`
+local interval = tonumber(ARGV[1])
+local queue_size = tonumber(ARGV[2])
+local max_wait = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+
+local admit_at = now
+local last = tonumber(redis.call('GET', KEYS[1]))
+if last then
+	admit_at = math.max(now, last + interval)
+end
+
+local wait = admit_at - now
+local queued = math.ceil(wait / interval - 1e-9)
+if wait > max_wait or queued > queue_size then
+	local retry_after = wait - math.min(max_wait, queue_size * interval)
+	return {0, 0, math.ceil(wait), math.max(1, math.ceil(retry_after)), 0}
+end
+
+local reset_after = math.ceil(wait + interval)
+if ARGV[5] ~= '1' then
+	redis.call('SET', KEYS[1], string.format('%.3f', admit_at), 'PX', reset_after)
+end
+return {1, queue_size - queued, reset_after, 0, math.ceil(wait)}
+`)
+
+// LeakyBucket lets requests leave at a constant rate of limit.Rate per limit.Period. Instead of rejecting requests that
+// arrive too early it schedules them, reporting in Result.AdmitAt when each one may proceed, and only rejects them when
+// more than limit.QueueSize are waiting or the wait would exceed limit.MaxWait.
+type LeakyBucket struct {
+	client cache.ClientInterface
+	now    func() time.Time
+}
+
+func NewLeakyBucket(client cache.ClientInterface) *LeakyBucket {
+	return &LeakyBucket{client: client, now: time.Now}
+}
+
+func (l *LeakyBucket) Allow(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return l.check(ctx, key, limit, false)
+}
+
+func (l *LeakyBucket) Peek(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return l.check(ctx, key, limit, true)
+}
+
+func (l *LeakyBucket) Reset(ctx context.Context, key string, limit Limit) error {
+	return l.client.Delete(ctx, key+":"+AlgorithmLeakyBucket)
+}
+
+func (l *LeakyBucket) check(ctx context.Context, key string, limit Limit, dry bool) (*Result, error) {
+	if limit.Rate <= 0 {
+		return &Result{Allowed: false, RetryAfter: limit.Period, ResetAfter: limit.Period}, nil
+	}
+
+	interval := float64(limit.Period.Milliseconds()) / float64(limit.Rate)
+	now := l.now()
+	key = key + ":" + AlgorithmLeakyBucket
+
+	scripter, ok := l.client.(cache.Scripter)
+	if !ok {
+		return run(ctx, l.client, key, l.step(limit, interval, now), dry)
+	}
+
+	reply, err := scripter.RunScript(ctx, leakyBucketScript, []string{key}, interval, limit.QueueSize, limit.MaxWait.Milliseconds(), now.UnixMilli(), dryRun(dry))
+	values, err := scriptReply(reply, err, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	result := resultFrom(values)
+	if result.Allowed {
+		result.AdmitAt = now.Add(time.Duration(values[4]) * time.Millisecond)
+	}
+	return result, nil
+}
+
+// step keeps the time in milliseconds the last queued request is scheduled at.
+func (l *LeakyBucket) step(limit Limit, interval float64, now time.Time) stepFunc {
+	ms := float64(now.UnixMilli())
+	maxWait := float64(limit.MaxWait.Milliseconds())
+	queueSize := float64(limit.QueueSize)
+
+	return func(value string, found bool) (string, time.Duration, bool, *Result) {
+		admitAt := ms
+		if state, ok := decodeState(value, 1); found && ok {
+			admitAt = math.Max(ms, state[0]+interval)
+		}
+
+		wait := admitAt - ms
+		queued := math.Ceil(wait/interval - 1e-9)
+		if wait > maxWait || queued > queueSize {
+			return "", 0, false, &Result{
+				ResetAfter: millis(wait),
+				RetryAfter: max(millis(wait-math.Min(maxWait, queueSize*interval)), time.Millisecond),
+			}
+		}
+
+		resetAfter := millis(wait + interval)
+		return encodeState(admitAt), resetAfter, true, &Result{
+			Allowed:    true,
+			Remaining:  int(queueSize - queued),
+			ResetAfter: resetAfter,
+			AdmitAt:    now.Add(millis(wait)),
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Package limiter implements the rate limiting algorithms used by the request repository.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AlgorithmFixedWindow   = "fixed_window"
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmSlidingLog    = "sliding_log"
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmGCRA          = "gcra"
+	AlgorithmLeakyBucket   = "leaky_bucket"
+)
+
+// Algorithms lists every algorithm New accepts.
+var Algorithms = []string{
+	AlgorithmFixedWindow,
+	AlgorithmTokenBucket,
+	AlgorithmSlidingLog,
+	AlgorithmSlidingWindow,
+	AlgorithmGCRA,
+	AlgorithmLeakyBucket,
+}
+
+// Limit describes how many requests a key may perform.
+type Limit struct {
+	// Rate is the number of requests allowed per Period.
+	Rate int
+	// Period is the window the Rate refers to.
+	Period time.Duration
+	// Burst is the number of requests allowed on top of Rate when the key has been idle.
+	Burst int
+	// QueueSize is how many requests a queueing strategy may hold waiting for their turn.
+	QueueSize int
+	// MaxWait is the longest a queueing strategy may delay a request before rejecting it instead.
+	MaxWait time.Duration
+}
+
+// Result is the outcome of a single rate limit check.
+type Result struct {
+	Allowed bool
+	// Remaining is the number of requests the key can still perform right now.
+	Remaining int
+	// ResetAfter is how long until the key is back to its full limit.
+	ResetAfter time.Duration
+	// RetryAfter is how long until the next request can be allowed. It is zero when the request was allowed.
+	RetryAfter time.Duration
+	// AdmitAt is when an allowed request may proceed. It is only set by queueing strategies; the zero value means the
+	// request may proceed right away.
+	AdmitAt time.Time
+}
+
+// Strategy decides whether a request identified by key is allowed under the given limit.
+// Every strategy runs as a Lua script on backends implementing cache.Scripter, such as Redis, and as the same algorithm
+// written in Go on top of cache.Update on the other ones.
+type Strategy interface {
+	Allow(ctx context.Context, key string, limit Limit) (*Result, error)
+}
+
+// Inspector is implemented by every strategy to report and clear the state of a key outside of the requests, for the
+// admin API.
+type Inspector interface {
+	// Peek returns the result Allow would return for a request made now, without counting it.
+	Peek(ctx context.Context, key string, limit Limit) (*Result, error)
+	// Reset forgets the requests counted for key, as if it had never been seen.
+	Reset(ctx context.Context, key string, limit Limit) error
+}
+
+var (
+	_ Inspector = (*FixedWindow)(nil)
+	_ Inspector = (*TokenBucket)(nil)
+	_ Inspector = (*SlidingLog)(nil)
+	_ Inspector = (*SlidingWindow)(nil)
+	_ Inspector = (*GCRA)(nil)
+	_ Inspector = (*LeakyBucket)(nil)
+)
+
+// New returns the strategy registered for the given algorithm, defaulting to the fixed window.
+func New(algorithm string, client cache.ClientInterface) (Strategy, error) {
+	switch algorithm {
+	case "", AlgorithmFixedWindow:
+		return NewFixedWindow(client), nil
+	case AlgorithmTokenBucket:
+		return NewTokenBucket(client), nil
+	case AlgorithmSlidingLog:
+		return NewSlidingLog(client), nil
+	case AlgorithmSlidingWindow:
+		return NewSlidingWindow(client), nil
+	case AlgorithmGCRA:
+		return NewGCRA(client), nil
+	case AlgorithmLeakyBucket:
+		return NewLeakyBucket(client), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm: %s", algorithm)
+	}
+}
+
+// newResult parses the {allowed, remaining, reset after, retry after} reply every script returns, durations being in
+// milliseconds.
+func newResult(reply interface{}, err error) (*Result, error) {
+	values, err := scriptReply(reply, err, 4)
+	if err != nil {
+		return nil, err
+	}
+	return resultFrom(values), nil
+}
+
+// scriptReply reads the integer array returned by a script, checking it has n elements.
+func scriptReply(reply interface{}, err error, n int) ([]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != n {
+		return nil, fmt.Errorf("unexpected rate limit script reply: %v", reply)
+	}
+
+	values := make([]int64, n)
+	for i, item := range items {
+		if values[i], ok = item.(int64); !ok {
+			return nil, fmt.Errorf("unexpected rate limit script reply: %v", reply)
+		}
+	}
+	return values, nil
+}
+
+func resultFrom(values []int64) *Result {
+	return &Result{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		ResetAfter: time.Duration(values[2]) * time.Millisecond,
+		RetryAfter: time.Duration(values[3]) * time.Millisecond,
+	}
+}
+
+// stepFunc is the Go counterpart of a strategy script: it computes the result and the next state of a key from its
+// current state.
+type stepFunc func(value string, found bool) (next string, ttl time.Duration, store bool, result *Result)
+
+// update runs step as an atomic read-modify-write of key on backends that cannot run the Lua scripts.
+func update(ctx context.Context, client cache.ClientInterface, key string, step stepFunc) (*Result, error) {
+	var result *Result
+	err := cache.Update(ctx, client, key, func(value string, found bool) (string, time.Duration, bool) {
+		next, ttl, store, r := step(value, found)
+		result = r
+		return next, ttl, store
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// run applies step to key with update, or only reads the current state of key when dry, without storing the next one.
+func run(ctx context.Context, client cache.ClientInterface, key string, step stepFunc, dry bool) (*Result, error) {
+	if !dry {
+		return update(ctx, client, key, step)
+	}
+
+	value, err := client.Get(ctx, key)
+	found := err == nil
+	if err != nil && !errors.Is(err, cache.ErrNotFound) {
+		return nil, err
+	}
+	_, _, _, result := step(value, found)
+	return result, nil
+}
+
+// dryRun is the script argument telling a strategy script to compute the result without writing anything.
+func dryRun(dry bool) int {
+	if dry {
+		return 1
+	}
+	return 0
+}
+
+// encodeState serializes the numbers a strategy keeps per key.
+func encodeState(values ...float64) string {
+	fields := make([]string, len(values))
+	for i, v := range values {
+		fields[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strings.Join(fields, " ")
+}
+
+// decodeState parses a state written by encodeState, reporting false when it does not hold n numbers.
+func decodeState(value string, n int) ([]float64, bool) {
+	fields := strings.Fields(value)
+	if n >= 0 && len(fields) != n {
+		return nil, false
+	}
+
+	values := make([]float64, len(fields))
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, false
+		}
+		values[i] = v
+	}
+	return values, true
+}
+
+// millis converts a number of milliseconds to a duration, rounding up like the scripts do.
+func millis(ms float64) time.Duration {
+	return time.Duration(math.Ceil(ms)) * time.Millisecond
+}
@@ -0,0 +1,565 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/redispkg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T) *redispkg.Client {
+	client, _ := newTestServer(t)
+	return client
+}
+
+func newTestServer(t *testing.T) (*redispkg.Client, *miniredis.Miniredis) {
+	srv := miniredis.RunT(t)
+	client := redispkg.NewClient(redis.NewClient(&redis.Options{Addr: srv.Addr()}))
+	t.Cleanup(func() { _ = client.Close() })
+	return client, srv
+}
+
+// fakeClock is a manually advanced clock shared by the strategies under test. When a server is attached, its key
+// expiration is fast-forwarded along with the clock.
+type fakeClock struct {
+	mu      sync.Mutex
+	current time.Time
+	srv     *miniredis.Miniredis
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{current: time.UnixMilli(1_700_000_000_000)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.current = c.current.Add(d)
+	c.mu.Unlock()
+
+	if c.srv != nil {
+		c.srv.FastForward(d)
+	}
+}
+
+// backends are the cache backends every strategy is tested against: Redis runs the Lua scripts, the in-memory backend
+// runs the Go implementation under its own lock and the last one hides that lock to go through compare-and-swap.
+var backends = []struct {
+	name string
+	new  func(t *testing.T, clock *fakeClock) cache.ClientInterface
+}{
+	{
+		name: "redis",
+		new: func(t *testing.T, clock *fakeClock) cache.ClientInterface {
+			client, srv := newTestServer(t)
+			clock.srv = srv
+			return client
+		},
+	},
+	{
+		name: "memory",
+		new: func(t *testing.T, clock *fakeClock) cache.ClientInterface {
+			client, err := memory.NewMemoryClient(&memory.ClientSettings{Now: clock.Now})
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = client.Close() })
+			return client
+		},
+	},
+	{
+		name: "compare_and_swap",
+		new: func(t *testing.T, clock *fakeClock) cache.ClientInterface {
+			client, err := memory.NewMemoryClient(&memory.ClientSettings{Now: clock.Now})
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = client.Close() })
+			return casOnly{client}
+		},
+	},
+}
+
+// casOnly exposes only the cache.ClientInterface methods of a backend.
+type casOnly struct {
+	cache.ClientInterface
+}
+
+// forEachBackend runs fn against every backend with a fresh clock.
+func forEachBackend(t *testing.T, fn func(t *testing.T, client cache.ClientInterface, clock *fakeClock)) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			clock := newFakeClock()
+			fn(t, b.new(t, clock), clock)
+		})
+	}
+}
+
+// newStrategy builds the strategy for algorithm driven by clock.
+func newStrategy(t *testing.T, algorithm string, client cache.ClientInterface, clock *fakeClock) Strategy {
+	s, err := New(algorithm, client)
+	require.NoError(t, err)
+
+	switch s := s.(type) {
+	case *FixedWindow:
+		s.now = clock.Now
+	case *TokenBucket:
+		s.now = clock.Now
+	case *SlidingLog:
+		s.now = clock.Now
+	case *SlidingWindow:
+		s.now = clock.Now
+	case *GCRA:
+		s.now = clock.Now
+	case *LeakyBucket:
+		s.now = clock.Now
+	}
+	return s
+}
+
+// allowN calls Allow n times and returns how many requests were admitted.
+func allowN(t *testing.T, s Strategy, key string, limit Limit, n int) int {
+	admitted := 0
+	for i := 0; i < n; i++ {
+		result, err := s.Allow(context.Background(), key, limit)
+		require.NoError(t, err)
+		if result.Allowed {
+			admitted++
+		}
+	}
+	return admitted
+}
+
+func allow(t *testing.T, s Strategy, key string, limit Limit) *Result {
+	result, err := s.Allow(context.Background(), key, limit)
+	require.NoError(t, err)
+	return result
+}
+
+func TestNew(t *testing.T) {
+	client := newTestClient(t)
+
+	t.Run("Defaults to the fixed window", func(t *testing.T) {
+		s, err := New("", client)
+		assert.NoError(t, err)
+		assert.IsType(t, &FixedWindow{}, s)
+	})
+
+	t.Run("Returns the token bucket", func(t *testing.T) {
+		s, err := New(AlgorithmTokenBucket, client)
+		assert.NoError(t, err)
+		assert.IsType(t, &TokenBucket{}, s)
+	})
+
+	t.Run("Returns the sliding window log", func(t *testing.T) {
+		s, err := New(AlgorithmSlidingLog, client)
+		assert.NoError(t, err)
+		assert.IsType(t, &SlidingLog{}, s)
+	})
+
+	t.Run("Returns the sliding window counter", func(t *testing.T) {
+		s, err := New(AlgorithmSlidingWindow, client)
+		assert.NoError(t, err)
+		assert.IsType(t, &SlidingWindow{}, s)
+	})
+
+	t.Run("Returns the GCRA", func(t *testing.T) {
+		s, err := New(AlgorithmGCRA, client)
+		assert.NoError(t, err)
+		assert.IsType(t, &GCRA{}, s)
+	})
+
+	t.Run("Returns the leaky bucket", func(t *testing.T) {
+		s, err := New(AlgorithmLeakyBucket, client)
+		assert.NoError(t, err)
+		assert.IsType(t, &LeakyBucket{}, s)
+	})
+
+	t.Run("Rejects unknown algorithms", func(t *testing.T) {
+		_, err := New("unknown", client)
+		assert.Error(t, err)
+	})
+}
+
+func TestFixedWindow(t *testing.T) {
+	limit := Limit{Rate: 2, Period: time.Second}
+
+	forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+		fw := newStrategy(t, AlgorithmFixedWindow, client, clock)
+
+		result := allow(t, fw, "fixed", limit)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 1, result.Remaining)
+		assert.Equal(t, time.Second, result.ResetAfter)
+
+		clock.Advance(400 * time.Millisecond)
+		result = allow(t, fw, "fixed", limit)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 0, result.Remaining)
+		assert.Equal(t, 600*time.Millisecond, result.ResetAfter)
+
+		result = allow(t, fw, "fixed", limit)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, 600*time.Millisecond, result.RetryAfter)
+
+		clock.Advance(300 * time.Millisecond)
+		result = allow(t, fw, "fixed", limit)
+		assert.False(t, result.Allowed)
+		assert.Equal(t, 300*time.Millisecond, result.RetryAfter, "rejections must not extend the window")
+
+		clock.Advance(300 * time.Millisecond)
+		assert.Equal(t, 2, allowN(t, fw, "fixed", limit, 3))
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	limit := Limit{Rate: 2, Period: time.Second, Burst: 3}
+
+	t.Run("Allows a burst up to the capacity", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			tb := newStrategy(t, AlgorithmTokenBucket, client, clock)
+
+			assert.Equal(t, 5, allowN(t, tb, "burst", limit, 10))
+		})
+	})
+
+	t.Run("Refills fractional tokens over time", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			tb := newStrategy(t, AlgorithmTokenBucket, client, clock)
+
+			assert.Equal(t, 5, allowN(t, tb, "refill", limit, 5))
+
+			clock.Advance(250 * time.Millisecond)
+			result := allow(t, tb, "refill", limit)
+			assert.False(t, result.Allowed)
+			assert.Equal(t, 250*time.Millisecond, result.RetryAfter)
+
+			clock.Advance(250 * time.Millisecond)
+			assert.Equal(t, 1, allowN(t, tb, "refill", limit, 2))
+		})
+	})
+
+	t.Run("Smooths sustained traffic to the refill rate", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			tb := newStrategy(t, AlgorithmTokenBucket, client, clock)
+
+			assert.Equal(t, 5, allowN(t, tb, "sustained", limit, 5))
+
+			admitted := 0
+			for i := 0; i < 10; i++ {
+				clock.Advance(100 * time.Millisecond)
+				admitted += allowN(t, tb, "sustained", limit, 3)
+			}
+			assert.Equal(t, 2, admitted)
+		})
+	})
+
+	t.Run("Never exceeds the capacity after being idle", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			tb := newStrategy(t, AlgorithmTokenBucket, client, clock)
+
+			assert.Equal(t, 5, allowN(t, tb, "idle", limit, 5))
+			clock.Advance(time.Hour)
+			assert.Equal(t, 5, allowN(t, tb, "idle", limit, 10))
+		})
+	})
+
+	t.Run("Reports the time until the next token", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			tb := newStrategy(t, AlgorithmTokenBucket, client, clock)
+			strict := Limit{Rate: 2, Period: time.Second}
+
+			allowN(t, tb, "bucket", strict, 2)
+			result := allow(t, tb, "bucket", strict)
+			assert.False(t, result.Allowed)
+			assert.Equal(t, 500*time.Millisecond, result.RetryAfter)
+			assert.Equal(t, time.Second, result.ResetAfter)
+		})
+	})
+}
+
+// boundaryBurst sends one request at the start of a window, fills the limit right before the window boundary and then
+// tries a full burst right after it, returning how many requests were admitted in the 100ms around the boundary.
+func boundaryBurst(t *testing.T, s Strategy, clock *fakeClock, limit Limit) int {
+	allowN(t, s, "boundary", limit, 1)
+
+	clock.Advance(900 * time.Millisecond)
+	admitted := allowN(t, s, "boundary", limit, limit.Rate-1)
+
+	clock.Advance(100 * time.Millisecond)
+	admitted += allowN(t, s, "boundary", limit, limit.Rate)
+
+	return admitted
+}
+
+func TestBoundaryBurst(t *testing.T) {
+	limit := Limit{Rate: 10, Period: time.Second}
+
+	t.Run("Fixed window admits twice the limit across the boundary", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			fw := newStrategy(t, AlgorithmFixedWindow, client, clock)
+
+			assert.Equal(t, 2*limit.Rate-1, boundaryBurst(t, fw, clock, limit))
+		})
+	})
+
+	t.Run("Sliding log admits at most the limit across the boundary", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			sl := newStrategy(t, AlgorithmSlidingLog, client, clock)
+
+			assert.Equal(t, limit.Rate, boundaryBurst(t, sl, clock, limit))
+		})
+	})
+
+	t.Run("Sliding window counter admits at most the limit across the boundary", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			sw := newStrategy(t, AlgorithmSlidingWindow, client, clock)
+
+			assert.LessOrEqual(t, boundaryBurst(t, sw, clock, limit), limit.Rate)
+		})
+	})
+}
+
+func TestSlidingLog(t *testing.T) {
+	limit := Limit{Rate: 3, Period: time.Second}
+
+	t.Run("Admits at most the limit in any window", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			sl := newStrategy(t, AlgorithmSlidingLog, client, clock)
+
+			assert.Equal(t, 1, allowN(t, sl, "log", limit, 1))
+			clock.Advance(500 * time.Millisecond)
+			assert.Equal(t, 2, allowN(t, sl, "log", limit, 5))
+
+			clock.Advance(499 * time.Millisecond)
+			assert.Equal(t, 0, allowN(t, sl, "log", limit, 1))
+
+			clock.Advance(1 * time.Millisecond)
+			assert.Equal(t, 1, allowN(t, sl, "log", limit, 5))
+		})
+	})
+
+	t.Run("Reports when the oldest request leaves the window", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			sl := newStrategy(t, AlgorithmSlidingLog, client, clock)
+			strict := Limit{Rate: 2, Period: time.Second}
+
+			allowN(t, sl, "log", strict, 1)
+			clock.Advance(300 * time.Millisecond)
+			assert.Equal(t, 0, allow(t, sl, "log", strict).Remaining)
+
+			result := allow(t, sl, "log", strict)
+			assert.False(t, result.Allowed)
+			assert.Equal(t, 700*time.Millisecond, result.RetryAfter)
+			assert.Equal(t, time.Second, result.ResetAfter)
+		})
+	})
+
+	t.Run("Reports the window when nothing is logged", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			sl := newStrategy(t, AlgorithmSlidingLog, client, clock)
+
+			result := allow(t, sl, "log", Limit{Rate: 0, Period: time.Second})
+			assert.False(t, result.Allowed)
+			assert.Equal(t, time.Second, result.ResetAfter)
+			assert.Equal(t, time.Second, result.RetryAfter)
+		})
+	})
+}
+
+func TestSlidingWindow(t *testing.T) {
+	t.Run("Weights the previous window", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			sw := newStrategy(t, AlgorithmSlidingWindow, client, clock)
+			limit := Limit{Rate: 10, Period: time.Second}
+
+			assert.Equal(t, 10, allowN(t, sw, "counter", limit, 15))
+
+			clock.Advance(time.Second)
+			assert.Equal(t, 0, allowN(t, sw, "counter", limit, 1))
+
+			clock.Advance(500 * time.Millisecond)
+			assert.Equal(t, 5, allowN(t, sw, "counter", limit, 10))
+
+			clock.Advance(time.Second)
+			assert.Equal(t, 7, allowN(t, sw, "counter", limit, 10))
+		})
+	})
+
+	t.Run("Reports when the weighted count drops below the limit", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			sw := newStrategy(t, AlgorithmSlidingWindow, client, clock)
+			limit := Limit{Rate: 2, Period: time.Second}
+
+			allowN(t, sw, "counter", limit, 2)
+			result := allow(t, sw, "counter", limit)
+			assert.False(t, result.Allowed)
+			assert.Equal(t, 1500*time.Millisecond, result.RetryAfter)
+
+			clock.Advance(result.RetryAfter)
+			assert.Equal(t, 1, allowN(t, sw, "counter", limit, 2))
+		})
+	})
+}
+
+func TestGCRA(t *testing.T) {
+	limit := Limit{Rate: 10, Period: time.Second, Burst: 0}
+
+	t.Run("Reports remaining capacity and reset time", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			g := newStrategy(t, AlgorithmGCRA, client, clock)
+
+			result := allow(t, g, "gcra", limit)
+			assert.True(t, result.Allowed)
+			assert.Equal(t, 9, result.Remaining)
+			assert.Equal(t, 100*time.Millisecond, result.ResetAfter)
+			assert.Zero(t, result.RetryAfter)
+
+			result = allow(t, g, "gcra", limit)
+			assert.Equal(t, 8, result.Remaining)
+			assert.Equal(t, 200*time.Millisecond, result.ResetAfter)
+		})
+	})
+
+	t.Run("Computes the exact retry after once exhausted", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			g := newStrategy(t, AlgorithmGCRA, client, clock)
+
+			assert.Equal(t, 10, allowN(t, g, "gcra", limit, 10))
+
+			clock.Advance(30 * time.Millisecond)
+			result := allow(t, g, "gcra", limit)
+			assert.False(t, result.Allowed)
+			assert.Equal(t, 0, result.Remaining)
+			assert.Equal(t, 70*time.Millisecond, result.RetryAfter)
+			assert.Equal(t, 970*time.Millisecond, result.ResetAfter)
+
+			clock.Advance(result.RetryAfter)
+			assert.Equal(t, 1, allowN(t, g, "gcra", limit, 2))
+		})
+	})
+
+	t.Run("Spaces sustained traffic at the emission interval", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			g := newStrategy(t, AlgorithmGCRA, client, clock)
+
+			assert.Equal(t, 10, allowN(t, g, "gcra", limit, 10))
+
+			admitted := 0
+			for i := 0; i < 20; i++ {
+				clock.Advance(50 * time.Millisecond)
+				admitted += allowN(t, g, "gcra", limit, 1)
+			}
+			assert.Equal(t, 10, admitted)
+		})
+	})
+
+	t.Run("Stores a single value per key", func(t *testing.T) {
+		client, srv := newTestServer(t)
+		clock := newFakeClock()
+		clock.srv = srv
+		g := newStrategy(t, AlgorithmGCRA, client, clock)
+
+		allowN(t, g, "gcra", limit, 5)
+		assert.Equal(t, []string{"gcra:" + AlgorithmGCRA}, srv.Keys())
+	})
+}
+
+func TestLeakyBucket(t *testing.T) {
+	limit := Limit{Rate: 10, Period: time.Second, QueueSize: 3, MaxWait: time.Second}
+
+	t.Run("Schedules requests one interval apart", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			l := newStrategy(t, AlgorithmLeakyBucket, client, clock)
+			start := clock.Now()
+
+			for i := 0; i < 4; i++ {
+				result := allow(t, l, "leaky", limit)
+				assert.True(t, result.Allowed)
+				assert.Equal(t, start.Add(time.Duration(i)*100*time.Millisecond), result.AdmitAt)
+				assert.Equal(t, 3-i, result.Remaining)
+			}
+		})
+	})
+
+	t.Run("Rejects requests once the queue is full", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			l := newStrategy(t, AlgorithmLeakyBucket, client, clock)
+
+			assert.Equal(t, 4, allowN(t, l, "leaky", limit, 4))
+
+			result := allow(t, l, "leaky", limit)
+			assert.False(t, result.Allowed)
+			assert.Equal(t, 100*time.Millisecond, result.RetryAfter)
+
+			clock.Advance(result.RetryAfter)
+			result = allow(t, l, "leaky", limit)
+			assert.True(t, result.Allowed)
+			assert.Equal(t, clock.Now().Add(300*time.Millisecond), result.AdmitAt)
+		})
+	})
+
+	t.Run("Rejects requests that would wait longer than the maximum wait", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			l := newStrategy(t, AlgorithmLeakyBucket, client, clock)
+			short := limit
+			short.MaxWait = 150 * time.Millisecond
+
+			assert.Equal(t, 2, allowN(t, l, "leaky", short, 5))
+		})
+	})
+
+	t.Run("Admits right away without a queue", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+			l := newStrategy(t, AlgorithmLeakyBucket, client, clock)
+			policer := Limit{Rate: 10, Period: time.Second}
+
+			result := allow(t, l, "leaky", policer)
+			assert.True(t, result.Allowed)
+			assert.Equal(t, clock.Now(), result.AdmitAt)
+			assert.Equal(t, 0, allowN(t, l, "leaky", policer, 1))
+		})
+	})
+}
+
+func TestInspector(t *testing.T) {
+	ctx := context.Background()
+	limit := Limit{Rate: 3, Period: time.Second, QueueSize: 3, MaxWait: time.Second}
+
+	for _, algorithm := range Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, client cache.ClientInterface, clock *fakeClock) {
+				s := newStrategy(t, algorithm, client, clock)
+				inspector := s.(Inspector)
+
+				allowN(t, s, "inspected", limit, 1)
+				peeked, err := inspector.Peek(ctx, "inspected", limit)
+				require.NoError(t, err)
+				assert.True(t, peeked.Allowed)
+
+				next := allow(t, s, "inspected", limit)
+				assert.Equal(t, next.Remaining, peeked.Remaining, "peeking does not count the request")
+
+				allowN(t, s, "inspected", limit, 10)
+				peeked, err = inspector.Peek(ctx, "inspected", limit)
+				require.NoError(t, err)
+				assert.False(t, peeked.Allowed)
+
+				require.NoError(t, inspector.Reset(ctx, "inspected", limit))
+				peeked, err = inspector.Peek(ctx, "inspected", limit)
+				require.NoError(t, err)
+				assert.True(t, peeked.Allowed)
+				assert.Equal(t, allow(t, s, "fresh", limit).Remaining, peeked.Remaining, "reset forgets the requests")
+			})
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"math/rand/v2"
+	"time"
+)
+
+// slidingLogScript keeps the timestamp of every admitted request in the sorted set stored at KEYS[1], dropping the ones
+// that fell out of the window before counting. ARGV[1] is the limit, ARGV[2] the window in milliseconds, ARGV[3] the
+// current time in milliseconds, ARGV[4] a unique member for the request and ARGV[5] is 1 to compute the result without
+// logging the request.
+var slidingLogScript = cache.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+
+if count >= limit then
+	local retry_after = window
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	if oldest[2] then
+		retry_after = tonumber(oldest[2]) + window - now
+	end
+	-- PTTL is -2 for a missing key, with a zero limit, and -1 for a key without expiration.
+	local reset = math.max(redis.call('PTTL', KEYS[1]), 0)
+	if reset == 0 then
+		reset = window
+	end
+	return {0, 0, reset, retry_after}
+end
+
+if ARGV[5] ~= '1' then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+end
+return {1, limit - count - 1, window, 0}
+`)
+
+// SlidingLog admits at most limit.Rate requests in any interval of limit.Period by logging every admitted request.
+// It is exact but uses memory proportional to the limit for every key.
+type SlidingLog struct {
+	client cache.ClientInterface
+	now    func() time.Time
+}
+
+func NewSlidingLog(client cache.ClientInterface) *SlidingLog {
+	return &SlidingLog{client: client, now: time.Now}
+}
+
+func (s *SlidingLog) Allow(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return s.check(ctx, key, limit, false)
+}
+
+func (s *SlidingLog) Peek(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return s.check(ctx, key, limit, true)
+}
+
+func (s *SlidingLog) Reset(ctx context.Context, key string, limit Limit) error {
+	return s.client.Delete(ctx, key+":"+AlgorithmSlidingLog)
+}
+
+func (s *SlidingLog) check(ctx context.Context, key string, limit Limit, dry bool) (*Result, error) {
+	now := s.now()
+	key = key + ":" + AlgorithmSlidingLog
+
+	if scripter, ok := s.client.(cache.Scripter); ok {
+		member := fmt.Sprintf("%d-%x", now.UnixNano(), rand.Uint64())
+		return newResult(scripter.RunScript(ctx, slidingLogScript, []string{key}, limit.Rate, limit.Period.Milliseconds(), now.UnixMilli(), member, dryRun(dry)))
+	}
+
+	return run(ctx, s.client, key, s.step(limit, float64(now.UnixMilli())), dry)
+}
+
+// step keeps the timestamps of the admitted requests, oldest first.
+func (s *SlidingLog) step(limit Limit, now float64) stepFunc {
+	window := float64(limit.Period.Milliseconds())
+	return func(value string, found bool) (string, time.Duration, bool, *Result) {
+		var log []float64
+		if state, ok := decodeState(value, -1); found && ok {
+			for _, ts := range state {
+				if ts > now-window {
+					log = append(log, ts)
+				}
+			}
+		}
+
+		if len(log) >= limit.Rate {
+			if len(log) == 0 {
+				return "", 0, false, &Result{ResetAfter: limit.Period, RetryAfter: limit.Period}
+			}
+			resetAfter := millis(log[len(log)-1] + window - now)
+			return encodeState(log...), resetAfter, true, &Result{
+				ResetAfter: resetAfter,
+				RetryAfter: millis(log[0] + window - now),
+			}
+		}
+
+		log = append(log, now)
+		return encodeState(log...), limit.Period, true, &Result{
+			Allowed:    true,
+			Remaining:  limit.Rate - len(log),
+			ResetAfter: limit.Period,
+		}
+	}
+}
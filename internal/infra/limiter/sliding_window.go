@@ -0,0 +1,134 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"math"
+	"time"
+)
+
+// slidingWindowScript estimates the number of requests in the last window by weighting the counter of the previous
+// fixed window (KEYS[2]) by how much of it still overlaps the sliding window and adding the current counter (KEYS[1]).
+// ARGV[1] is the limit, ARGV[2] the window in milliseconds, ARGV[3] the current time in milliseconds and ARGV[4] is 1 to
+// compute the result without counting the request.
+var slidingWindowScript = cache.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local previous = tonumber(redis.call('GET', KEYS[2]) or '0')
+local elapsed = now % window
+local weighted = previous * (window - elapsed) / window + current
+
+if weighted + 1 > limit then
+	local retry_after
+	if current + 1 > limit then
+		retry_after = window - elapsed
+		if current > 0 then
+			retry_after = retry_after + math.max(0, window * (1 - (limit - 1) / current))
+		end
+	else
+		retry_after = window * (1 - (limit - current - 1) / previous) - elapsed
+	end
+	return {0, 0, 2 * window - elapsed, math.max(1, math.ceil(retry_after))}
+end
+
+if ARGV[4] ~= '1' then
+	redis.call('INCR', KEYS[1])
+	redis.call('PEXPIRE', KEYS[1], window * 2)
+end
+return {1, math.floor(limit - weighted - 1), 2 * window - elapsed, 0}
+`)
+
+// SlidingWindow approximates a sliding window with two fixed window counters, which keeps memory constant per key
+// while avoiding the bursts a fixed window allows across its boundary.
+type SlidingWindow struct {
+	client cache.ClientInterface
+	now    func() time.Time
+}
+
+func NewSlidingWindow(client cache.ClientInterface) *SlidingWindow {
+	return &SlidingWindow{client: client, now: time.Now}
+}
+
+func (s *SlidingWindow) Allow(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return s.check(ctx, key, limit, false)
+}
+
+func (s *SlidingWindow) Peek(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return s.check(ctx, key, limit, true)
+}
+
+// Reset deletes the single key of the Go algorithm along with both counters of the script.
+func (s *SlidingWindow) Reset(ctx context.Context, key string, limit Limit) error {
+	current := s.now().UnixMilli() / limit.Period.Milliseconds()
+	return s.client.Delete(ctx, append(s.keys(key, current), key+":"+AlgorithmSlidingWindow)...)
+}
+
+func (s *SlidingWindow) check(ctx context.Context, key string, limit Limit, dry bool) (*Result, error) {
+	window := limit.Period.Milliseconds()
+	now := s.now().UnixMilli()
+
+	if scripter, ok := s.client.(cache.Scripter); ok {
+		return newResult(scripter.RunScript(ctx, slidingWindowScript, s.keys(key, now/window), limit.Rate, window, now, dryRun(dry)))
+	}
+
+	return run(ctx, s.client, key+":"+AlgorithmSlidingWindow, s.step(limit, window, now), dry)
+}
+
+// keys returns the keys of the script counters of the current window and of the previous one.
+func (s *SlidingWindow) keys(key string, current int64) []string {
+	return []string{
+		fmt.Sprintf("%s:%s:%d", key, AlgorithmSlidingWindow, current),
+		fmt.Sprintf("%s:%s:%d", key, AlgorithmSlidingWindow, current-1),
+	}
+}
+
+// step keeps both counters in a single value along with the index of the current window, shifting them when a new
+// window starts.
+func (s *SlidingWindow) step(limit Limit, window, now int64) stepFunc {
+	index := now / window
+	elapsed := float64(now % window)
+	w := float64(window)
+	rate := float64(limit.Rate)
+
+	return func(value string, found bool) (string, time.Duration, bool, *Result) {
+		var current, previous float64
+		if state, ok := decodeState(value, 3); found && ok {
+			switch int64(state[0]) {
+			case index:
+				current, previous = state[1], state[2]
+			case index - 1:
+				previous = state[1]
+			}
+		}
+
+		weighted := previous*(w-elapsed)/w + current
+		resetAfter := millis(2*w - elapsed)
+
+		if weighted+1 > rate {
+			var retryAfter float64
+			if current+1 > rate {
+				retryAfter = w - elapsed
+				if current > 0 {
+					retryAfter += math.Max(0, w*(1-(rate-1)/current))
+				}
+			} else {
+				retryAfter = w*(1-(rate-current-1)/previous) - elapsed
+			}
+			return "", 0, false, &Result{
+				ResetAfter: resetAfter,
+				RetryAfter: max(millis(retryAfter), time.Millisecond),
+			}
+		}
+
+		current++
+		return encodeState(float64(index), current, previous), resetAfter, true, &Result{
+			Allowed:    true,
+			Remaining:  int(math.Floor(rate - weighted - 1)),
+			ResetAfter: resetAfter,
+		}
+	}
+}
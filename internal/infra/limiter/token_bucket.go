@@ -0,0 +1,108 @@
+package limiter
+
+import (
+	"context"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"math"
+	"time"
+)
+
+// tokenBucketScript refills the bucket stored at KEYS[1] according to the time elapsed since the last request and
+// takes one token from it when available. Tokens are kept as a float so slow rates still refill between requests.
+// ARGV[1] is the capacity, ARGV[2] the refill rate in tokens per millisecond, ARGV[3] the current time in milliseconds
+// and ARGV[4] is 1 to compute the result without taking the token.
+var tokenBucketScript = cache.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry_after = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry_after = math.ceil((1 - tokens) / rate)
+end
+
+local reset_after = math.max(1, math.ceil((capacity - tokens) / rate))
+if ARGV[4] ~= '1' then
+	redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ARGV[3])
+	redis.call('PEXPIRE', KEYS[1], reset_after)
+end
+return {allowed, math.floor(tokens), reset_after, retry_after}
+`)
+
+// TokenBucket refills limit.Rate tokens every limit.Period up to a capacity of limit.Rate + limit.Burst, which lets
+// idle clients burst briefly before being smoothed to the refill rate.
+type TokenBucket struct {
+	client cache.ClientInterface
+	now    func() time.Time
+}
+
+func NewTokenBucket(client cache.ClientInterface) *TokenBucket {
+	return &TokenBucket{client: client, now: time.Now}
+}
+
+func (t *TokenBucket) Allow(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return t.check(ctx, key, limit, false)
+}
+
+func (t *TokenBucket) Peek(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return t.check(ctx, key, limit, true)
+}
+
+func (t *TokenBucket) Reset(ctx context.Context, key string, limit Limit) error {
+	return t.client.Delete(ctx, key+":"+AlgorithmTokenBucket)
+}
+
+func (t *TokenBucket) check(ctx context.Context, key string, limit Limit, dry bool) (*Result, error) {
+	capacity := limit.Rate + limit.Burst
+	if limit.Rate <= 0 || capacity <= 0 {
+		return &Result{Allowed: false, RetryAfter: limit.Period, ResetAfter: limit.Period}, nil
+	}
+
+	rate := float64(limit.Rate) / float64(limit.Period.Milliseconds())
+	now := t.now().UnixMilli()
+	key = key + ":" + AlgorithmTokenBucket
+
+	if scripter, ok := t.client.(cache.Scripter); ok {
+		return newResult(scripter.RunScript(ctx, tokenBucketScript, []string{key}, capacity, rate, now, dryRun(dry)))
+	}
+
+	return run(ctx, t.client, key, t.step(float64(capacity), rate, float64(now)), dry)
+}
+
+// step keeps the number of tokens along with the time they were counted at.
+func (t *TokenBucket) step(capacity, rate, now float64) stepFunc {
+	return func(value string, found bool) (string, time.Duration, bool, *Result) {
+		tokens, ts := capacity, now
+		if state, ok := decodeState(value, 2); found && ok {
+			tokens, ts = state[0], state[1]
+		}
+
+		tokens = math.Min(capacity, tokens+math.Max(0, now-ts)*rate)
+
+		result := &Result{}
+		if tokens >= 1 {
+			tokens--
+			result.Allowed = true
+		} else {
+			result.RetryAfter = millis((1 - tokens) / rate)
+		}
+
+		result.Remaining = int(math.Floor(tokens))
+		result.ResetAfter = max(millis((capacity-tokens)/rate), time.Millisecond)
+		return encodeState(tokens, now), result.ResetAfter, true, result
+	}
+}
@@ -0,0 +1,93 @@
+// Package logging builds the structured logger of the rate limiter and carries it in the request contexts, where it is
+// tagged with the request ID and the trace ID so that the log lines of a request can be correlated.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// New returns the logger writing to w in format, one of the LOG_FORMAT values, from level on, one of the LOG_LEVEL
+// values. Empty values default to text and info.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("unknown log level: %s", level)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", confpkg.LogFormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case confpkg.LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+}
+
+type contextKey struct{}
+
+// WithLogger returns a copy of ctx carrying logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger when there is none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Middleware carries logger in the request contexts, tagged with the request ID set by chi's RequestID middleware,
+// which is returned in the X-Request-Id header, and with the trace ID when the request is traced. Every request is
+// logged once served.
+func Middleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			requestLogger := logger
+			if id := middleware.GetReqID(r.Context()); id != "" {
+				requestLogger = requestLogger.With("request_id", id)
+				w.Header().Set(middleware.RequestIDHeader, id)
+			}
+			if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+				requestLogger = requestLogger.With("trace_id", sc.TraceID().String())
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(WithLogger(r.Context(), requestLogger)))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			attrs := []any{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", status,
+				"bytes", ww.BytesWritten(),
+				"duration", time.Since(start),
+				"remote_addr", r.RemoteAddr,
+			}
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				attrs = append(attrs, "route", rctx.RoutePattern())
+			}
+			requestLogger.Info("request", attrs...)
+		})
+	}
+}
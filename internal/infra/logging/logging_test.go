@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "warn")
+	require.NoError(t, err)
+	logger.Info("dropped")
+	logger.Warn("kept", "key", "value")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "kept", line["msg"])
+	assert.Equal(t, "value", line["key"])
+
+	buf.Reset()
+	logger, err = New(&buf, "", "")
+	require.NoError(t, err)
+	logger.Info("hello")
+	assert.Contains(t, buf.String(), "msg=hello")
+
+	_, err = New(&buf, "xml", "")
+	assert.Error(t, err)
+	_, err = New(&buf, "text", "loud")
+	assert.Error(t, err)
+}
+
+func TestFromContext(t *testing.T) {
+	assert.Same(t, slog.Default(), FromContext(context.Background()))
+
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	assert.Same(t, logger, FromContext(WithLogger(context.Background(), logger)))
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "")
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID, Middleware(logger))
+	r.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Info("handling")
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	req := httptest.NewRequest("GET", "/items/1", nil)
+	req.Header.Set(middleware.RequestIDHeader, "abc-123")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, "abc-123", rr.Header().Get(middleware.RequestIDHeader))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	var handling, request map[string]any
+	require.NoError(t, json.Unmarshal(lines[0], &handling))
+	require.NoError(t, json.Unmarshal(lines[1], &request))
+	assert.Equal(t, "abc-123", handling["request_id"])
+	assert.Equal(t, "abc-123", request["request_id"])
+	assert.Equal(t, "request", request["msg"])
+	assert.Equal(t, "/items/{id}", request["route"])
+	assert.Equal(t, float64(http.StatusTeapot), request["status"])
+}
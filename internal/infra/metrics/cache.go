@@ -0,0 +1,19 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+)
+
+// Cache returns client measuring the latency of its operations, with the same optional interfaces as client.
+func (m *Metrics) Cache(client cache.ClientInterface) cache.ClientInterface {
+	if m == nil {
+		return client
+	}
+	return cache.Wrap(client, func(ctx context.Context, operation string) (context.Context, func(error), error) {
+		start := time.Now()
+		return ctx, func(error) { m.cache.WithLabelValues(operation).Observe(time.Since(start).Seconds()) }, nil
+	})
+}
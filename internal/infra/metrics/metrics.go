@@ -0,0 +1,209 @@
+// Package metrics exposes the Prometheus metrics of the rate limiter: the decisions taken per policy and route, the
+// latency of the rate limit checks and of the cache backend, the bans in effect and the Go runtime metrics. Every
+// method of a nil *Metrics is a no-op, so components work without metrics.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/breaker"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ratelimiter"
+
+// Outcomes of a decision.
+const (
+	OutcomeAllowed  = "allowed"
+	OutcomeRejected = "rejected"
+	OutcomeError    = "error"
+	// OutcomeCanceled counts the queued requests whose client went away before their turn.
+	OutcomeCanceled = "canceled"
+)
+
+// Policies labelling the decisions taken by the allow and deny lists rather than by a rate limit policy.
+const (
+	PolicyAllowlist = "allowlist"
+	PolicyDenylist  = "denylist"
+)
+
+// banScrapeTimeout bounds how long counting the bans may delay a scrape.
+const banScrapeTimeout = 5 * time.Second
+
+// banCountTTL is how long the count of the bans is reused by the scrapes, as counting them scans the whole keyspace.
+const banCountTTL = 30 * time.Second
+
+// latencyBuckets go from 100µs to about 3s, as checks usually take a single round trip to the cache.
+var latencyBuckets = prometheus.ExponentialBuckets(0.0001, 2, 16)
+
+type Metrics struct {
+	registry  *prometheus.Registry
+	decisions *prometheus.CounterVec
+	checks    *prometheus.HistogramVec
+	cache     *prometheus.HistogramVec
+	failures  *prometheus.CounterVec
+	breaker   prometheus.Gauge
+	// transitions counts the state changes of the breaker by their from and to states.
+	transitions *prometheus.CounterVec
+}
+
+// New returns the metrics registered on a registry of their own along with the Go runtime and process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decisions_total",
+			Help:      "Rate limit decisions by policy, route and outcome (allowed, rejected, error or canceled).",
+		}, []string{"policy", "route", "outcome"}),
+		checks: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "check_duration_seconds",
+			Help:      "Latency of CheckRateLimit by policy.",
+			Buckets:   latencyBuckets,
+		}, []string{"policy"}),
+		cache: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "cache_operation_duration_seconds",
+			Help:      "Latency of the cache backend operations.",
+			Buckets:   latencyBuckets,
+		}, []string{"operation"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "backend_failures_total",
+			Help:      "Requests decided by the failure mode of their policy (closed, open or local) because the cache backend failed.",
+		}, []string{"policy", "mode"}),
+		breaker: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_breaker_state",
+			Help:      "State of the circuit breaker of the cache backend: 0 closed, 1 half open, 2 open.",
+		}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_breaker_transitions_total",
+			Help:      "State changes of the circuit breaker of the cache backend.",
+		}, []string{"from", "to"}),
+	}
+	m.registry.MustRegister(
+		m.decisions,
+		m.checks,
+		m.cache,
+		m.failures,
+		m.breaker,
+		m.transitions,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	if m == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Decision counts a decision taken for policy on route, the chi pattern of the request.
+func (m *Metrics) Decision(policy, route, outcome string) {
+	if m == nil {
+		return
+	}
+	m.decisions.WithLabelValues(policy, route, outcome).Inc()
+}
+
+// Failure counts a request decided by the failure mode of policy because the cache backend failed.
+func (m *Metrics) Failure(policy, mode string) {
+	if m == nil {
+		return
+	}
+	m.failures.WithLabelValues(policy, mode).Inc()
+}
+
+// Breaker records a state change of the circuit breaker of the cache backend.
+func (m *Metrics) Breaker(from, to breaker.State) {
+	if m == nil {
+		return
+	}
+	m.breaker.Set(float64(to))
+	m.transitions.WithLabelValues(from.String(), to.String()).Inc()
+}
+
+// Repository returns repository measuring the latency of its CheckRateLimit.
+func (m *Metrics) Repository(repository entity.RequestRepositoryInterface) entity.RequestRepositoryInterface {
+	if m == nil {
+		return repository
+	}
+	return &instrumentedRepository{repository: repository, checks: m.checks}
+}
+
+type instrumentedRepository struct {
+	repository entity.RequestRepositoryInterface
+	checks     *prometheus.HistogramVec
+}
+
+func (r *instrumentedRepository) CheckRateLimit(ctx context.Context, key string, policy entity.Policy) (*entity.Decision, error) {
+	start := time.Now()
+	defer func() { r.checks.WithLabelValues(policy.Name).Observe(time.Since(start).Seconds()) }()
+	return r.repository.CheckRateLimit(ctx, key, policy)
+}
+
+// Bans registers the ratelimiter_active_bans gauge, counted with list at most once every banCountTTL whatever the
+// rate of the scrapes. It is not exported when list fails, such as on backends that cannot list their keys.
+func (m *Metrics) Bans(list func(ctx context.Context) ([]entity.Ban, error)) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(&banCollector{
+		list: list,
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "active_bans"), "Bans in effect.", nil, nil),
+		now:  time.Now,
+	})
+}
+
+type banCollector struct {
+	list func(ctx context.Context) ([]entity.Ban, error)
+	desc *prometheus.Desc
+	// now is replaced by the tests.
+	now func() time.Time
+
+	// mu also keeps concurrent scrapes from listing the bans together.
+	mu        sync.Mutex
+	count     int
+	counted   bool
+	countedAt time.Time
+}
+
+func (c *banCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *banCollector) Collect(ch chan<- prometheus.Metric) {
+	count, ok := c.bans()
+	if !ok {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count))
+}
+
+// bans returns the number of bans, listing them again once the previous count, or failure, is older than banCountTTL.
+func (c *banCollector) bans() (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := c.now(); c.countedAt.IsZero() || now.Sub(c.countedAt) >= banCountTTL {
+		ctx, cancel := context.WithTimeout(context.Background(), banScrapeTimeout)
+		defer cancel()
+
+		bans, err := c.list(ctx)
+		c.count, c.counted, c.countedAt = len(bans), err == nil, now
+	}
+	return c.count, c.counted
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/breaker"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/redispkg"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type mockRepository struct {
+	mock.Mock
+}
+
+func (m *mockRepository) CheckRateLimit(ctx context.Context, key string, p entity.Policy) (*entity.Decision, error) {
+	args := m.Called(ctx, key, p)
+	decision, _ := args.Get(0).(*entity.Decision)
+	return decision, args.Error(1)
+}
+
+func TestDecision(t *testing.T) {
+	m := New()
+	m.Decision("default", "/rate-limiter-active", OutcomeAllowed)
+	m.Decision("default", "/rate-limiter-active", OutcomeAllowed)
+	m.Decision("login", "/login", OutcomeRejected)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.decisions.WithLabelValues("default", "/rate-limiter-active", OutcomeAllowed)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.decisions.WithLabelValues("login", "/login", OutcomeRejected)))
+
+	var none *Metrics
+	assert.NotPanics(t, func() { none.Decision("default", "/", OutcomeError) })
+}
+
+func TestRepository(t *testing.T) {
+	m := New()
+	repo := new(mockRepository)
+	repo.On("CheckRateLimit", mock.Anything, "key", entity.Policy{Name: "login"}).Return(&entity.Decision{Allowed: true}, nil)
+
+	decision, err := m.Repository(repo).CheckRateLimit(context.Background(), "key", entity.Policy{Name: "login"})
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 1, testutil.CollectAndCount(m.checks, "ratelimiter_check_duration_seconds"))
+
+	var none *Metrics
+	assert.Same(t, repo, none.Repository(repo))
+}
+
+func implements[T any](v any) bool {
+	_, ok := v.(T)
+	return ok
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Keeps the optional interfaces of the backend", func(t *testing.T) {
+		m := New()
+		srv := miniredis.RunT(t)
+		rdb := redispkg.NewClient(redis.NewClient(&redis.Options{Addr: srv.Addr()}))
+		mem, err := memory.NewMemoryClient(&memory.ClientSettings{})
+		require.NoError(t, err)
+		defer mem.Close()
+
+		instrumented := m.Cache(rdb)
+		assert.Implements(t, (*cache.Scripter)(nil), instrumented)
+		assert.Implements(t, (*cache.Scanner)(nil), instrumented)
+		assert.False(t, implements[cache.Updater](instrumented))
+
+		instrumented = m.Cache(mem)
+		assert.Implements(t, (*cache.Updater)(nil), instrumented)
+		assert.Implements(t, (*cache.Scanner)(nil), instrumented)
+		assert.False(t, implements[cache.Scripter](instrumented))
+
+		instrumented = m.Cache(struct{ cache.ClientInterface }{mem})
+		assert.False(t, implements[cache.Updater](instrumented))
+		assert.False(t, implements[cache.Scanner](instrumented))
+	})
+
+	t.Run("Measures the operations", func(t *testing.T) {
+		m := New()
+		mem, err := memory.NewMemoryClient(&memory.ClientSettings{})
+		require.NoError(t, err)
+		defer mem.Close()
+		client := m.Cache(mem)
+
+		require.NoError(t, client.Set(ctx, "key", "1", time.Minute))
+		_, err = client.Get(ctx, "key")
+		require.NoError(t, err)
+		require.NoError(t, cache.Update(ctx, client, "key", func(value string, found bool) (string, time.Duration, bool) {
+			return "2", time.Minute, true
+		}))
+
+		assert.Equal(t, 3, testutil.CollectAndCount(m.cache), "one series per operation")
+		value, err := mem.Get(ctx, "key")
+		require.NoError(t, err)
+		assert.Equal(t, "2", value)
+	})
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.Decision("default", "/rate-limiter-active", OutcomeRejected)
+	m.Bans(func(ctx context.Context) ([]entity.Ban, error) {
+		return []entity.Ban{{Key: "a"}, {Key: "b"}}, nil
+	})
+
+	rr := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	assert.Contains(t, body, `ratelimiter_decisions_total{outcome="rejected",policy="default",route="/rate-limiter-active"} 1`)
+	assert.Contains(t, body, "ratelimiter_active_bans 2")
+	assert.Contains(t, body, "go_goroutines")
+
+	t.Run("Omits the bans when they cannot be listed", func(t *testing.T) {
+		m := New()
+		m.Bans(func(ctx context.Context) ([]entity.Ban, error) { return nil, cache.ErrNotSupported })
+
+		rr := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		assert.NotContains(t, rr.Body.String(), "ratelimiter_active_bans")
+	})
+
+	t.Run("Reuses the count of the bans between scrapes", func(t *testing.T) {
+		now := time.Now()
+		calls := 0
+		c := &banCollector{
+			list: func(ctx context.Context) ([]entity.Ban, error) {
+				calls++
+				return make([]entity.Ban, calls), nil
+			},
+			now: func() time.Time { return now },
+		}
+
+		for i := 0; i < 3; i++ {
+			count, ok := c.bans()
+			assert.True(t, ok)
+			assert.Equal(t, 1, count)
+		}
+		now = now.Add(banCountTTL)
+		count, _ := c.bans()
+		assert.Equal(t, 2, count)
+		assert.Equal(t, 2, calls)
+	})
+}
+
+func TestBreaker(t *testing.T) {
+	m := New()
+	m.Breaker(breaker.Closed, breaker.Open)
+	m.Breaker(breaker.Open, breaker.HalfOpen)
+
+	assert.Equal(t, float64(breaker.HalfOpen), testutil.ToFloat64(m.breaker))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.transitions.WithLabelValues("closed", "open")))
+
+	var none *Metrics
+	assert.NotPanics(t, func() { none.Breaker(breaker.Open, breaker.Closed) })
+}
@@ -0,0 +1,386 @@
+// Package policy loads the rate limit rules from a YAML or JSON file and matches them against incoming requests.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultName is the name of the policy built from the environment configuration, applied to the requests no rule
+// matches.
+const DefaultName = "default"
+
+// Key sources. A key combines one or more sources with "+", for instance "sub+route" limiting each user on each route
+// separately. Requests lacking a source are keyed by their IP in its place.
+const (
+	// KeyIP limits each client IP separately. It is the default key source.
+	KeyIP = "ip"
+	// KeyAPIKey limits each token sent in the API_KEY header separately.
+	KeyAPIKey = "api_key"
+	// KeySubject limits each sub claim of the JWT token separately.
+	KeySubject = "sub"
+	// KeyToken limits each JWT token identity separately, its sub claim or its jti when it has no subject.
+	KeyToken = "token"
+	// KeyRoute limits each route pattern separately, such as "/users/{id}".
+	KeyRoute = "route"
+	// KeyHeaderPrefix followed by a header name limits each value of that header separately, for instance
+	// "header:X-Api-Key".
+	KeyHeaderPrefix = "header:"
+	// KeyQueryPrefix followed by a query parameter name limits each value of that parameter separately, for instance
+	// "query:client_id".
+	KeyQueryPrefix = "query:"
+)
+
+// KeySource is one of the sources a key combines. Name is the header or query parameter name of the KeyHeaderPrefix
+// and KeyQueryPrefix sources.
+type KeySource struct {
+	Kind string
+	Name string
+}
+
+// ParseKey splits key into its sources. An empty key is KeyIP.
+func ParseKey(key string) ([]KeySource, error) {
+	if key == "" {
+		key = KeyIP
+	}
+
+	var sources []KeySource
+	for _, part := range strings.Split(key, "+") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == KeyIP, part == KeyAPIKey, part == KeySubject, part == KeyToken, part == KeyRoute:
+			sources = append(sources, KeySource{Kind: part})
+		case strings.HasPrefix(part, KeyHeaderPrefix) && part != KeyHeaderPrefix:
+			sources = append(sources, KeySource{Kind: KeyHeaderPrefix, Name: strings.TrimPrefix(part, KeyHeaderPrefix)})
+		case strings.HasPrefix(part, KeyQueryPrefix) && part != KeyQueryPrefix:
+			sources = append(sources, KeySource{Kind: KeyQueryPrefix, Name: strings.TrimPrefix(part, KeyQueryPrefix)})
+		default:
+			return nil, fmt.Errorf("unknown key source %q", part)
+		}
+	}
+	return sources, nil
+}
+
+// Duration is a time.Duration read from strings such as "500ms", "1s" or "1m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	return d.parse(value.Value)
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	s, err := strconv.Unquote(string(data))
+	if err != nil {
+		return fmt.Errorf("invalid duration %s: expected a string such as \"1s\"", data)
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Rule limits the requests matching its path pattern and methods.
+type Rule struct {
+	// Name namespaces the keys of the rule. It defaults to rule_<position in the file>.
+	Name string `yaml:"name" json:"name"`
+	// Path is a path.Match pattern such as "/users/*", or a prefix when it ends with "/**", "/api/**" matching "/api"
+	// and everything below it.
+	Path string `yaml:"path" json:"path"`
+	// Methods restricts the rule to these HTTP methods. An empty list matches every method.
+	Methods []string `yaml:"methods" json:"methods"`
+	// Key is the key source, or several sources joined with "+", as parsed by ParseKey.
+	Key       string   `yaml:"key" json:"key"`
+	Algorithm string   `yaml:"algorithm" json:"algorithm"`
+	Limit     int      `yaml:"limit" json:"limit"`
+	Window    Duration `yaml:"window" json:"window"`
+	Block     Duration `yaml:"block" json:"block"`
+	// ExtendBan restarts the ban of a key for Block on every request it sends while banned.
+	ExtendBan bool `yaml:"extend_ban" json:"extend_ban"`
+	// Penalties escalate the ban of repeat offenders, replacing Block, such as [10s, 1m, 10m, 1h].
+	Penalties    []Duration `yaml:"penalties" json:"penalties"`
+	PenaltyDecay Duration   `yaml:"penalty_decay" json:"penalty_decay"`
+	Burst        int        `yaml:"burst" json:"burst"`
+	QueueSize    int        `yaml:"queue_size" json:"queue_size"`
+	MaxWait      Duration   `yaml:"max_wait" json:"max_wait"`
+	// FailureMode decides the requests while the cache backend fails: closed, open or local. It defaults to the
+	// FAILURE_MODE of the current configuration.
+	FailureMode string `yaml:"failure_mode" json:"failure_mode"`
+}
+
+// Policy returns the limit the rule applies. Rules that do not name an algorithm or a failure mode use the
+// RATE_LIMIT_ALGORITHM and FAILURE_MODE of the current configuration.
+func (r *Rule) Policy() entity.Policy {
+	algorithm := r.Algorithm
+	if algorithm == "" {
+		algorithm = defaultAlgorithm(confpkg.Current())
+	}
+	failureMode := r.FailureMode
+	if failureMode == "" {
+		failureMode = defaultFailureMode(confpkg.Current())
+	}
+
+	return entity.Policy{
+		Name:         r.Name,
+		Algorithm:    algorithm,
+		Limit:        r.Limit,
+		Window:       time.Duration(r.Window),
+		Block:        time.Duration(r.Block),
+		ExtendBan:    r.ExtendBan,
+		Penalties:    durations(r.Penalties),
+		PenaltyDecay: time.Duration(r.PenaltyDecay),
+		Burst:        r.Burst,
+		QueueSize:    r.QueueSize,
+		MaxWait:      time.Duration(r.MaxWait),
+		FailureMode:  failureMode,
+	}
+}
+
+func (r *Rule) matches(method, p string) bool {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, strings.ToUpper(method)) {
+		return false
+	}
+
+	if prefix, ok := strings.CutSuffix(r.Path, "/**"); ok {
+		return p == prefix || strings.HasPrefix(p, prefix+"/")
+	}
+
+	matched, _ := path.Match(r.Path, p)
+	return matched
+}
+
+type file struct {
+	Rules []Rule `yaml:"rules" json:"rules"`
+}
+
+// Set is an ordered list of rules where the first rule matching a request wins. A nil Set matches nothing.
+type Set struct {
+	rules []Rule
+}
+
+// Load reads the rules from filename, decoded as JSON when its extension is .json and as YAML otherwise.
+func Load(filename string) (*Set, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("policy file: %w", err)
+	}
+
+	var f file
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", filename, err)
+	}
+
+	set, err := NewSet(f.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", filename, err)
+	}
+	return set, nil
+}
+
+// NewSet validates the rules and fills in their defaults.
+func NewSet(rules []Rule) (*Set, error) {
+	set := &Set{rules: make([]Rule, len(rules))}
+	names := make(map[string]bool, len(rules))
+
+	var errs []error
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = "rule_" + strconv.Itoa(i+1)
+		}
+		if rule.Key == "" {
+			rule.Key = KeyIP
+		}
+		rule.Methods = slices.Clone(rule.Methods)
+		for j, method := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(method)
+		}
+
+		if err := rule.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.Name, err))
+		}
+		if names[rule.Name] {
+			errs = append(errs, fmt.Errorf("rule %s: duplicated name", rule.Name))
+		}
+		names[rule.Name] = true
+
+		set.rules[i] = rule
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return set, nil
+}
+
+func (r *Rule) validate() error {
+	switch {
+	case strings.ContainsFunc(r.Name, func(c rune) bool { return c <= ' ' }):
+		return errors.New("name must not contain spaces")
+	case !strings.HasPrefix(r.Path, "/"):
+		return errors.New("path must start with /")
+	case r.Algorithm != "" && !slices.Contains(limiter.Algorithms, r.Algorithm):
+		return fmt.Errorf("unknown rate limit algorithm %q", r.Algorithm)
+	case r.Limit <= 0:
+		return errors.New("limit must be greater than zero")
+	case r.Window <= 0:
+		return errors.New("window must be greater than zero")
+	case time.Duration(r.Window)%time.Millisecond != 0:
+		// The limiters count in whole milliseconds, so shorter windows round down to zero.
+		return errors.New("window must be a whole number of milliseconds")
+	case r.Block < 0, r.MaxWait < 0, r.Burst < 0, r.QueueSize < 0, r.PenaltyDecay < 0:
+		return errors.New("block, max_wait, burst, queue_size and penalty_decay must not be negative")
+	case slices.ContainsFunc(r.Penalties, func(d Duration) bool { return d <= 0 }):
+		return errors.New("penalties must be greater than zero")
+	case r.FailureMode != "" && !slices.Contains(failureModes, r.FailureMode):
+		return fmt.Errorf("unknown failure mode %q", r.FailureMode)
+	}
+
+	if _, err := ParseKey(r.Key); err != nil {
+		return err
+	}
+	if _, err := path.Match(r.Path, "/"); err != nil {
+		return fmt.Errorf("invalid path %q: %w", r.Path, err)
+	}
+	return nil
+}
+
+// Match returns the first rule matching the request method and path.
+func (s *Set) Match(method, p string) (*Rule, bool) {
+	if s == nil {
+		return nil, false
+	}
+	for i := range s.rules {
+		if s.rules[i].matches(method, p) {
+			return &s.rules[i], true
+		}
+	}
+	return nil, false
+}
+
+// Rule returns the rule named name.
+func (s *Set) Rule(name string) (*Rule, bool) {
+	if s == nil {
+		return nil, false
+	}
+	for i := range s.rules {
+		if s.rules[i].Name == name {
+			return &s.rules[i], true
+		}
+	}
+	return nil, false
+}
+
+// Rules returns a copy of the rules in matching order.
+func (s *Set) Rules() []Rule {
+	if s == nil {
+		return nil
+	}
+	return slices.Clone(s.rules)
+}
+
+// Holder holds the Set in use, swapped atomically when the policy file is reloaded. A nil Holder holds no rules.
+type Holder struct {
+	set atomic.Pointer[Set]
+}
+
+func NewHolder(set *Set) *Holder {
+	h := &Holder{}
+	h.Store(set)
+	return h
+}
+
+// Get returns the Set in use, which may be nil.
+func (h *Holder) Get() *Set {
+	if h == nil {
+		return nil
+	}
+	return h.set.Load()
+}
+
+// Store replaces the Set in use.
+func (h *Holder) Store(set *Set) {
+	h.set.Store(set)
+}
+
+// Default returns the policy applied to the requests no rule matches: limit requests per second with the algorithm,
+// block duration, penalties, queue and failure mode from the current configuration.
+func Default(limit int) entity.Policy {
+	conf := confpkg.Current()
+	// The configuration is validated before being activated.
+	penalties, decay, _ := conf.Penalties()
+	return entity.Policy{
+		Name:         DefaultName,
+		Algorithm:    defaultAlgorithm(conf),
+		Limit:        limit,
+		Window:       time.Second,
+		Block:        time.Duration(conf.TimeoutDuration) * time.Second,
+		ExtendBan:    conf.BanExtendOnReject,
+		Penalties:    penalties,
+		PenaltyDecay: decay,
+		Burst:        conf.TokenBucketBurst,
+		QueueSize:    conf.QueueSize,
+		MaxWait:      time.Duration(conf.QueueMaxWaitMs) * time.Millisecond,
+		FailureMode:  defaultFailureMode(conf),
+	}
+}
+
+func durations(ds []Duration) []time.Duration {
+	if len(ds) == 0 {
+		return nil
+	}
+	converted := make([]time.Duration, len(ds))
+	for i, d := range ds {
+		converted[i] = time.Duration(d)
+	}
+	return converted
+}
+
+// failureModes are the values of the failure_mode of the rules.
+var failureModes = []string{confpkg.FailureModeClosed, confpkg.FailureModeOpen, confpkg.FailureModeLocal}
+
+// defaultFailureMode names the failure mode of conf explicitly, closed when FAILURE_MODE is not set or no
+// configuration was loaded.
+func defaultFailureMode(conf *confpkg.Conf) string {
+	if conf == nil || conf.FailureMode == "" {
+		return confpkg.FailureModeClosed
+	}
+	return conf.FailureMode
+}
+
+// defaultAlgorithm names the algorithm of conf explicitly, so that policies follow RATE_LIMIT_ALGORITHM when it is
+// reloaded instead of falling back to the strategy the repository was started with. It is fixed_window when
+// RATE_LIMIT_ALGORITHM is not set or no configuration was loaded.
+func defaultAlgorithm(conf *confpkg.Conf) string {
+	if conf == nil || conf.RateLimitAlgorithm == "" {
+		return limiter.AlgorithmFixedWindow
+	}
+	return conf.RateLimitAlgorithm
+}
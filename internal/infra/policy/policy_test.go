@@ -0,0 +1,246 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"github.com/mayckol/rate-limiter/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0o600))
+	return filename
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("Loads the example file", func(t *testing.T) {
+		set, err := Load(filepath.Join(utils.RootPath(), "policy.example.yaml"))
+		require.NoError(t, err)
+
+		rules := set.Rules()
+		require.Len(t, rules, 2)
+		assert.Equal(t, entity.Policy{
+			Name:        "login",
+			Algorithm:   "sliding_window",
+			Limit:       5,
+			Window:      time.Minute,
+			Block:       5 * time.Minute,
+			ExtendBan:   true,
+			FailureMode: confpkg.FailureModeClosed,
+		}, rules[0].Policy())
+		assert.Equal(t, "header:X-Api-Key", rules[1].Key)
+		assert.Equal(t, 20, rules[1].Burst)
+		assert.Equal(t, confpkg.FailureModeLocal, rules[1].Policy().FailureMode)
+	})
+
+	t.Run("Loads JSON", func(t *testing.T) {
+		filename := writeFile(t, "policy.json", `{"rules": [{"path": "/login", "methods": ["post"], "limit": 5, "window": "1m"}]}`)
+
+		set, err := Load(filename)
+		require.NoError(t, err)
+
+		rules := set.Rules()
+		require.Len(t, rules, 1)
+		assert.Equal(t, "rule_1", rules[0].Name)
+		assert.Equal(t, KeyIP, rules[0].Key)
+		assert.Equal(t, []string{"POST"}, rules[0].Methods)
+		assert.Equal(t, Duration(time.Minute), rules[0].Window)
+	})
+
+	t.Run("Rejects unknown fields", func(t *testing.T) {
+		filename := writeFile(t, "policy.yaml", "rules:\n  - path: /login\n    limit: 5\n    window: 1m\n    limt: 6\n")
+
+		_, err := Load(filename)
+		assert.ErrorContains(t, err, "limt")
+	})
+
+	t.Run("Rejects invalid durations", func(t *testing.T) {
+		filename := writeFile(t, "policy.json", `{"rules": [{"path": "/login", "limit": 5, "window": 60}]}`)
+
+		_, err := Load(filename)
+		assert.ErrorContains(t, err, "invalid duration")
+	})
+
+	t.Run("Reports a missing file", func(t *testing.T) {
+		_, err := Load(filepath.Join(t.TempDir(), "missing.yaml"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestNewSet(t *testing.T) {
+	valid := Rule{Path: "/login", Limit: 5, Window: Duration(time.Minute)}
+
+	tests := []struct {
+		name   string
+		modify func(r *Rule)
+		err    string
+	}{
+		{"relative path", func(r *Rule) { r.Path = "login" }, "path must start with /"},
+		{"bad pattern", func(r *Rule) { r.Path = "/[login" }, "invalid path"},
+		{"unknown key source", func(r *Rule) { r.Key = "cookie" }, "unknown key source"},
+		{"empty header", func(r *Rule) { r.Key = KeyHeaderPrefix }, "unknown key source"},
+		{"empty query", func(r *Rule) { r.Key = "sub+" + KeyQueryPrefix }, "unknown key source"},
+		{"unknown algorithm", func(r *Rule) { r.Algorithm = "random" }, "unknown rate limit algorithm"},
+		{"zero limit", func(r *Rule) { r.Limit = 0 }, "limit must be greater than zero"},
+		{"zero window", func(r *Rule) { r.Window = 0 }, "window must be greater than zero"},
+		{"sub-millisecond window", func(r *Rule) { r.Window = Duration(500 * time.Microsecond) }, "window must be a whole number of milliseconds"},
+		{"fractional millisecond window", func(r *Rule) { r.Window = Duration(1500 * time.Microsecond) }, "window must be a whole number of milliseconds"},
+		{"negative block", func(r *Rule) { r.Block = Duration(-time.Second) }, "must not be negative"},
+		{"zero penalty", func(r *Rule) { r.Penalties = []Duration{Duration(time.Second), 0} }, "penalties must be greater than zero"},
+		{"negative decay", func(r *Rule) { r.PenaltyDecay = Duration(-time.Hour) }, "must not be negative"},
+		{"name with spaces", func(r *Rule) { r.Name = "log in" }, "name must not contain spaces"},
+		{"unknown failure mode", func(r *Rule) { r.FailureMode = "retry" }, "unknown failure mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := valid
+			tt.modify(&rule)
+
+			_, err := NewSet([]Rule{rule})
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+
+	t.Run("Rejects duplicated names", func(t *testing.T) {
+		rule := valid
+		rule.Name = "login"
+
+		_, err := NewSet([]Rule{rule, rule})
+		assert.ErrorContains(t, err, "duplicated name")
+	})
+}
+
+func TestParseKey(t *testing.T) {
+	sources, err := ParseKey("")
+	require.NoError(t, err)
+	assert.Equal(t, []KeySource{{Kind: KeyIP}}, sources)
+
+	sources, err = ParseKey("sub + route+header:X-Tenant+query:client_id+api_key")
+	require.NoError(t, err)
+	assert.Equal(t, []KeySource{
+		{Kind: KeySubject},
+		{Kind: KeyRoute},
+		{Kind: KeyHeaderPrefix, Name: "X-Tenant"},
+		{Kind: KeyQueryPrefix, Name: "client_id"},
+		{Kind: KeyAPIKey},
+	}, sources)
+
+	for _, key := range []string{"ip+", "cookie", "header:", "sub+query:"} {
+		_, err := ParseKey(key)
+		assert.ErrorContains(t, err, "unknown key source", key)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	set, err := NewSet([]Rule{
+		{Name: "login", Path: "/login", Methods: []string{"POST"}, Limit: 5, Window: Duration(time.Minute)},
+		{Name: "users", Path: "/users/*", Limit: 10, Window: Duration(time.Second)},
+		{Name: "api", Path: "/api/**", Limit: 50, Window: Duration(time.Second)},
+		{Name: "catch_all", Path: "/**", Methods: []string{"DELETE"}, Limit: 1, Window: Duration(time.Second)},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		method, path, rule string
+	}{
+		{"POST", "/login", "login"},
+		{"post", "/login", "login"},
+		{"GET", "/login", ""},
+		{"GET", "/users/1", "users"},
+		{"GET", "/users/1/posts", ""},
+		{"GET", "/api", "api"},
+		{"GET", "/api/v1/items", "api"},
+		{"GET", "/apis", ""},
+		{"DELETE", "/api/v1/items", "api"},
+		{"DELETE", "/login", "catch_all"},
+	}
+	for _, tt := range tests {
+		rule, ok := set.Match(tt.method, tt.path)
+		if tt.rule == "" {
+			assert.False(t, ok, "%s %s", tt.method, tt.path)
+			continue
+		}
+		if assert.True(t, ok, "%s %s", tt.method, tt.path) {
+			assert.Equal(t, tt.rule, rule.Name, "%s %s", tt.method, tt.path)
+		}
+	}
+
+	var nilSet *Set
+	_, ok := nilSet.Match("GET", "/")
+	assert.False(t, ok)
+}
+
+func TestDefault(t *testing.T) {
+	_, _, err := confpkg.LoadConfig(true)
+	require.NoError(t, err)
+
+	p := Default(7)
+	assert.Equal(t, DefaultName, p.Name)
+	assert.Equal(t, 7, p.Limit)
+	assert.Equal(t, time.Second, p.Window)
+	assert.Equal(t, time.Duration(confpkg.Current().TimeoutDuration)*time.Second, p.Block)
+	assert.Equal(t, limiter.AlgorithmFixedWindow, p.Algorithm)
+
+	conf := *confpkg.Current()
+	conf.RateLimitAlgorithm = limiter.AlgorithmGCRA
+	confpkg.Activate(&conf)
+	defer func() { _, _, _ = confpkg.LoadConfig(true) }()
+
+	assert.Equal(t, limiter.AlgorithmGCRA, Default(7).Algorithm)
+	assert.False(t, Default(7).ExtendBan)
+	conf.BanExtendOnReject = true
+	assert.True(t, Default(7).ExtendBan)
+	assert.Empty(t, Default(7).Penalties)
+	conf.PenaltyDurations = "10s, 1m,10m"
+	conf.PenaltyDecay = "1h"
+	assert.Equal(t, []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute}, Default(7).Penalties)
+	assert.Equal(t, time.Hour, Default(7).PenaltyDecay)
+	rule := Rule{Name: "rule", Limit: 1, Window: Duration(time.Second)}
+	assert.Equal(t, limiter.AlgorithmGCRA, rule.Policy().Algorithm)
+	rule.Algorithm = limiter.AlgorithmSlidingLog
+	assert.Equal(t, limiter.AlgorithmSlidingLog, rule.Policy().Algorithm)
+	rule.Penalties = []Duration{Duration(time.Minute), Duration(time.Hour)}
+	rule.PenaltyDecay = Duration(48 * time.Hour)
+	assert.Equal(t, []time.Duration{time.Minute, time.Hour}, rule.Policy().Penalties)
+	assert.Equal(t, 48*time.Hour, rule.Policy().PenaltyDecay)
+
+	assert.Equal(t, confpkg.FailureModeClosed, Default(7).FailureMode)
+	conf.FailureMode = confpkg.FailureModeOpen
+	assert.Equal(t, confpkg.FailureModeOpen, Default(7).FailureMode)
+	assert.Equal(t, confpkg.FailureModeOpen, rule.Policy().FailureMode)
+	rule.FailureMode = confpkg.FailureModeLocal
+	assert.Equal(t, confpkg.FailureModeLocal, rule.Policy().FailureMode)
+}
+
+func TestRulePolicyWithoutConfiguration(t *testing.T) {
+	previous := confpkg.Current()
+	confpkg.Activate(nil)
+	defer confpkg.Activate(previous)
+
+	rule := Rule{Name: "rule", Limit: 1, Window: Duration(time.Second)}
+	p := rule.Policy()
+	assert.Equal(t, limiter.AlgorithmFixedWindow, p.Algorithm)
+	assert.Equal(t, confpkg.FailureModeClosed, p.FailureMode)
+}
+
+func TestHolder(t *testing.T) {
+	var nilHolder *Holder
+	assert.Nil(t, nilHolder.Get())
+
+	first, err := NewSet([]Rule{{Path: "/a", Limit: 1, Window: Duration(time.Second)}})
+	require.NoError(t, err)
+	holder := NewHolder(first)
+	assert.Same(t, first, holder.Get())
+
+	holder.Store(nil)
+	_, ok := holder.Get().Match("GET", "/a")
+	assert.False(t, ok)
+}
@@ -0,0 +1,209 @@
+// Package reload reloads the configuration and the policy file without restarting the server, on SIGHUP or when one
+// of the files changes.
+package reload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/infra/access"
+	"github.com/mayckol/rate-limiter/internal/infra/httppkg/clientip"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultInterval is how often the files are checked for changes when CONFIG_WATCH_INTERVAL_MS is not set.
+const DefaultInterval = 2 * time.Second
+
+type Reloader struct {
+	// Policies receives the rules of the policy file on every successful reload.
+	Policies *policy.Holder
+	// Logger reports the reloads and their failures.
+	Logger *slog.Logger
+
+	mu     sync.Mutex
+	stamps map[string]stamp
+}
+
+// stamp identifies a version of a watched file. A missing file has the zero stamp.
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func NewReloader(policies *policy.Holder, logger *slog.Logger) *Reloader {
+	return &Reloader{Policies: policies, Logger: logger}
+}
+
+// Reload reads the configuration and the policy file it names and activates both together. Nothing is activated when
+// either is invalid, so the previous configuration stays in use.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conf, invalidVars, err := confpkg.Read()
+	if invalidVars != nil {
+		var errs []error
+		for _, v := range *invalidVars {
+			errs = append(errs, fmt.Errorf("invalid var %s: %s", v.Field, v.Reason))
+		}
+		return errors.Join(errs...)
+	}
+	if err != nil {
+		return err
+	}
+	if conf.RateLimitAlgorithm != "" && !slices.Contains(limiter.Algorithms, conf.RateLimitAlgorithm) {
+		return fmt.Errorf("unknown rate limit algorithm: %s", conf.RateLimitAlgorithm)
+	}
+	if _, err := clientip.NewResolver(conf.TrustedProxies); err != nil {
+		return err
+	}
+	if _, err := policy.ParseKey(conf.RateLimitKey); err != nil {
+		return fmt.Errorf("RATE_LIMIT_KEY: %w", err)
+	}
+	if _, err := access.ParseList(conf.Allowlist); err != nil {
+		return fmt.Errorf("ALLOWLIST: %w", err)
+	}
+	if _, err := access.ParseList(conf.Denylist); err != nil {
+		return fmt.Errorf("DENYLIST: %w", err)
+	}
+
+	var set *policy.Set
+	if conf.PolicyFile != "" {
+		if set, err = policy.Load(conf.PolicyFile); err != nil {
+			return err
+		}
+	}
+
+	if previous := confpkg.Current(); previous != nil {
+		for _, name := range restartOnly(previous, conf) {
+			r.Logger.Warn("reload: variable changed, it only takes effect after a restart", "variable", name)
+		}
+	}
+
+	confpkg.Activate(conf)
+	r.Policies.Store(set)
+	r.stamps = r.read(conf)
+	return nil
+}
+
+// restartOnly returns the variables that changed between previous and next but are only read on start, as the cache
+// client and the listener are not recreated.
+func restartOnly(previous, next *confpkg.Conf) []string {
+	var names []string
+	fields := []struct {
+		name           string
+		previous, next string
+	}{
+		{"APP_ENV", previous.AppEnv, next.AppEnv},
+		{"WS_HOST", previous.WSHost, next.WSHost},
+		{"CACHE_DRIVER", previous.CacheDriver, next.CacheDriver},
+		{"REDIS_HOST", previous.RedisHost, next.RedisHost},
+		{"REDIS_PORT", previous.RedisPort, next.RedisPort},
+		{"REDIS_CACHE_KEY", previous.RedisCacheKey, next.RedisCacheKey},
+		{"MEMCACHED_SERVERS", previous.MemcachedServers, next.MemcachedServers},
+		{"MEMORY_MAX_ENTRIES", fmt.Sprint(previous.MemoryMaxEntries), fmt.Sprint(next.MemoryMaxEntries)},
+		{"REDIS_MAX_RETRIES", fmt.Sprint(previous.RedisMaxRetries), fmt.Sprint(next.RedisMaxRetries)},
+		{"CACHE_TIMEOUT_MS", fmt.Sprint(previous.CacheTimeoutMs), fmt.Sprint(next.CacheTimeoutMs)},
+		{"CACHE_BREAKER_FAILURES", fmt.Sprint(previous.CacheBreakerFailures), fmt.Sprint(next.CacheBreakerFailures)},
+		{"CACHE_BREAKER_COOLDOWN_MS", fmt.Sprint(previous.CacheBreakerCooldownMs), fmt.Sprint(next.CacheBreakerCooldownMs)},
+		{"CONFIG_WATCH_INTERVAL_MS", fmt.Sprint(previous.ConfigWatchIntervalMs), fmt.Sprint(next.ConfigWatchIntervalMs)},
+		{"TRACING_EXPORTER", previous.TracingExporter, next.TracingExporter},
+		{"LOG_FORMAT", previous.LogFormat, next.LogFormat},
+		{"LOG_LEVEL", previous.LogLevel, next.LogLevel},
+	}
+	for _, f := range fields {
+		if f.previous != f.next {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// Watch reloads on SIGHUP and whenever the .env file or the policy file changes, checking them every interval, until
+// ctx is done. Failed reloads are logged and keep the previous configuration.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	r.mu.Lock()
+	if r.stamps == nil {
+		r.stamps = r.read(confpkg.Current())
+	}
+	r.mu.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			r.reload("SIGHUP")
+		case <-ticker.C:
+			if r.changed() {
+				r.reload("file change")
+			}
+		}
+	}
+}
+
+func (r *Reloader) reload(reason string) {
+	if err := r.Reload(); err != nil {
+		r.Logger.Error("reload failed, keeping the previous configuration", "reason", reason, "error", err)
+		return
+	}
+	r.Logger.Info("reload: configuration and policies activated", "reason", reason)
+}
+
+// changed reports whether a watched file differs from the version read by the last reload. The stamps are updated,
+// so an invalid file is not reloaded again until it changes once more.
+func (r *Reloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamps := r.read(confpkg.Current())
+	changed := len(stamps) != len(r.stamps)
+	for name, s := range stamps {
+		if previous, ok := r.stamps[name]; !ok || !previous.modTime.Equal(s.modTime) || previous.size != s.size {
+			changed = true
+		}
+	}
+	r.stamps = stamps
+	return changed
+}
+
+// read returns the stamps of the .env file and of the policy file named by conf.
+func (r *Reloader) read(conf *confpkg.Conf) map[string]stamp {
+	names := []string{confpkg.Filename()}
+	if conf != nil && conf.PolicyFile != "" {
+		names = append(names, conf.PolicyFile)
+	}
+
+	stamps := make(map[string]stamp, len(names))
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		var s stamp
+		if info, err := os.Stat(name); err == nil {
+			s = stamp{modTime: info.ModTime(), size: info.Size()}
+		}
+		stamps[name] = s
+	}
+	return stamps
+}
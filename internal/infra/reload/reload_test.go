@@ -0,0 +1,134 @@
+package reload
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const env = `APP_ENV=local
+WS_HOST=0.0.0.0:8080
+JWT_KEY=secret
+TOKEN_EXPIRES_IN_SEC=10
+TIMEOUT_DURATION=10
+`
+
+const rules = `rules:
+  - name: login
+    path: /login
+    limit: 5
+    window: 1m
+`
+
+// setup writes a .env file with the extra lines and a policy file into a temporary directory and loads them.
+func setup(t *testing.T, extra string) (envFile, policyFile string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	envFile = filepath.Join(dir, ".env")
+	policyFile = filepath.Join(dir, "policy.yaml")
+	require.NoError(t, os.WriteFile(policyFile, []byte(rules), 0o600))
+	write(t, envFile, extra+"POLICY_FILE="+policyFile+"\n")
+
+	_, _, err := confpkg.LoadConfigFile(envFile)
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _, _ = confpkg.LoadConfig(true) })
+
+	return envFile, policyFile
+}
+
+func write(t *testing.T, envFile, extra string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(envFile, []byte(env+extra), 0o600))
+}
+
+func TestReload(t *testing.T) {
+	t.Run("Activates the changed configuration and policies", func(t *testing.T) {
+		envFile, policyFile := setup(t, "DEFAULT_MAX_REQ_PER_SEC=3\n")
+		holder := policy.NewHolder(nil)
+		reloader := NewReloader(holder, slog.Default())
+
+		write(t, envFile, "DEFAULT_MAX_REQ_PER_SEC=7\nRATE_LIMIT_ALGORITHM=gcra\nPOLICY_FILE="+policyFile+"\n")
+		require.NoError(t, reloader.Reload())
+
+		assert.Equal(t, 7, confpkg.Current().DefaultMaxReqPerSec)
+		assert.Equal(t, "gcra", confpkg.Current().RateLimitAlgorithm)
+		_, ok := holder.Get().Match("GET", "/login")
+		assert.True(t, ok)
+	})
+
+	t.Run("Unsets the variables removed from the file", func(t *testing.T) {
+		envFile, policyFile := setup(t, "DEFAULT_MAX_REQ_PER_SEC=3\nQUEUE_SIZE=4\n")
+		assert.Equal(t, 4, confpkg.Current().QueueSize)
+
+		write(t, envFile, "DEFAULT_MAX_REQ_PER_SEC=3\nPOLICY_FILE="+policyFile+"\n")
+		require.NoError(t, NewReloader(policy.NewHolder(nil), slog.Default()).Reload())
+		assert.Zero(t, confpkg.Current().QueueSize)
+	})
+
+	t.Run("Keeps the previous configuration when the new one is invalid", func(t *testing.T) {
+		envFile, policyFile := setup(t, "DEFAULT_MAX_REQ_PER_SEC=3\n")
+		previous := confpkg.Current()
+		set, err := policy.Load(policyFile)
+		require.NoError(t, err)
+		holder := policy.NewHolder(set)
+		reloader := NewReloader(holder, slog.Default())
+
+		invalid := []string{
+			"DEFAULT_MAX_REQ_PER_SEC=0\nPOLICY_FILE=" + policyFile + "\n",
+			"DEFAULT_MAX_REQ_PER_SEC=3\nRATE_LIMIT_ALGORITHM=unknown\nPOLICY_FILE=" + policyFile + "\n",
+			"DEFAULT_MAX_REQ_PER_SEC=3\nDENYLIST=example.com\nPOLICY_FILE=" + policyFile + "\n",
+			"DEFAULT_MAX_REQ_PER_SEC=3\nLOG_FORMAT=xml\nPOLICY_FILE=" + policyFile + "\n",
+			"DEFAULT_MAX_REQ_PER_SEC=3\nPOLICY_FILE=" + filepath.Join(filepath.Dir(policyFile), "missing.yaml") + "\n",
+		}
+		for _, extra := range invalid {
+			write(t, envFile, extra)
+			assert.Error(t, reloader.Reload(), extra)
+			assert.Same(t, previous, confpkg.Current(), extra)
+			assert.Same(t, set, holder.Get(), extra)
+		}
+
+		write(t, envFile, "DEFAULT_MAX_REQ_PER_SEC=3\nPOLICY_FILE="+policyFile+"\n")
+		require.NoError(t, os.WriteFile(policyFile, []byte("rules:\n  - path: login\n"), 0o600))
+		assert.Error(t, reloader.Reload())
+		assert.Same(t, previous, confpkg.Current())
+		assert.Same(t, set, holder.Get())
+	})
+}
+
+func TestWatch(t *testing.T) {
+	envFile, policyFile := setup(t, "DEFAULT_MAX_REQ_PER_SEC=3\n")
+	holder := policy.NewHolder(nil)
+	reloader := NewReloader(holder, slog.Default())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		reloader.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	write(t, envFile, "DEFAULT_MAX_REQ_PER_SEC=12\nPOLICY_FILE="+policyFile+"\n")
+	assert.Eventually(t, func() bool {
+		return confpkg.Current().DefaultMaxReqPerSec == 12
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(policyFile, []byte(rules+"  - name: search\n    path: /search\n    limit: 1\n    window: 1s\n"), 0o600))
+	assert.Eventually(t, func() bool {
+		_, ok := holder.Get().Match("GET", "/search")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/logging"
+)
+
+var _ entity.RequestRepositoryInterface = (*FailoverRepository)(nil)
+
+// FailoverRepository checks the requests with Primary and, when it fails, decides them by the failure mode of their
+// policy instead of failing them all.
+type FailoverRepository struct {
+	Primary entity.RequestRepositoryInterface
+	// Local limits the requests of the policies failing over to a local limiter, usually a RequestRepository on the
+	// in-memory cache. They fail closed when it is nil.
+	Local entity.RequestRepositoryInterface
+}
+
+func NewFailoverRepository(primary, local entity.RequestRepositoryInterface) *FailoverRepository {
+	return &FailoverRepository{Primary: primary, Local: local}
+}
+
+// CheckRateLimit checks the request with Primary. When the backend of Primary is unavailable, as told by
+// cache.IsUnavailable, policies failing open allow the request, policies failing over to the local limiter check it
+// there against the share of the limit of this instance, one FAILURE_LOCAL_INSTANCES-th, and the other ones fail
+// closed with an error wrapping cache.ErrUnavailable. The decisions taken without Primary carry the failure mode.
+// Other errors are returned as they are.
+func (r *FailoverRepository) CheckRateLimit(ctx context.Context, key string, policy entity.Policy) (*entity.Decision, error) {
+	decision, err := r.Primary.CheckRateLimit(ctx, key, policy)
+	if err == nil || ctx.Err() != nil || !cache.IsUnavailable(err) {
+		// A request given up by its client says nothing about the backend, and the other errors, such as a value of
+		// the wrong type, would not go away by deciding the request without it.
+		return decision, err
+	}
+
+	logger := logging.FromContext(ctx)
+	switch policy.FailureMode {
+	case confpkg.FailureModeOpen:
+		logger.Warn("cache backend failed, allowing the request", "key", key, "policy", policy.Name, "error", err)
+		return &entity.Decision{
+			Allowed:     true,
+			Limit:       policy.Limit,
+			Window:      policy.Window,
+			Remaining:   policy.Limit,
+			Policy:      policy.Name,
+			FailureMode: confpkg.FailureModeOpen,
+		}, nil
+	case confpkg.FailureModeLocal:
+		if r.Local == nil {
+			break
+		}
+		local := policy
+		local.Limit = localShare(policy.Limit, confpkg.Current().FailureLocalInstances)
+		decision, localErr := r.Local.CheckRateLimit(ctx, key, local)
+		if localErr != nil {
+			err = errors.Join(err, localErr)
+			break
+		}
+		logger.Warn("cache backend failed, limiting the request locally", "key", key, "policy", policy.Name, "limit", local.Limit, "error", err)
+		decision.FailureMode = confpkg.FailureModeLocal
+		return decision, nil
+	}
+	return nil, fmt.Errorf("%w: %w", cache.ErrUnavailable, err)
+}
+
+// localShare returns the part of limit each of instances enforces on its own, rounded up so that no policy drops to
+// zero.
+func localShare(limit, instances int) int {
+	if instances <= 1 {
+		return limit
+	}
+	return (limit + instances - 1) / instances
+}
@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/breaker"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/redispkg"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverRepository(t *testing.T) {
+	_, _, err := confpkg.LoadConfig(true)
+	require.NoError(t, err)
+	conf := *confpkg.Current()
+	conf.FailureLocalInstances = 2
+	previous := confpkg.Current()
+	confpkg.Activate(&conf)
+	defer confpkg.Activate(previous)
+
+	srv := miniredis.RunT(t)
+	client := redispkg.NewClient(redis.NewClient(&redis.Options{Addr: srv.Addr(), MaxRetries: -1}))
+	defer client.Close()
+	local, err := memory.NewMemoryClient(&memory.ClientSettings{})
+	require.NoError(t, err)
+	defer local.Close()
+
+	repo := NewFailoverRepository(NewRequestRepository(client, limiter.NewFixedWindow(client)), NewRequestRepository(local, limiter.NewFixedWindow(local)))
+	ctx := context.Background()
+	p := entity.Policy{Name: "api", Algorithm: limiter.AlgorithmFixedWindow, Limit: 3, Window: time.Minute, FailureMode: confpkg.FailureModeLocal}
+
+	decision, err := repo.CheckRateLimit(ctx, "key", p)
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Empty(t, decision.FailureMode, "the backend is up")
+
+	srv.Close()
+
+	t.Run("Limits locally to the share of the instance", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			decision, err := repo.CheckRateLimit(ctx, "local", p)
+			require.NoError(t, err)
+			assert.True(t, decision.Allowed)
+			assert.Equal(t, confpkg.FailureModeLocal, decision.FailureMode)
+			assert.Equal(t, 2, decision.Limit)
+		}
+		decision, err := repo.CheckRateLimit(ctx, "local", p)
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+	})
+
+	t.Run("Allows when failing open", func(t *testing.T) {
+		open := p
+		open.FailureMode = confpkg.FailureModeOpen
+		for i := 0; i < 5; i++ {
+			decision, err := repo.CheckRateLimit(ctx, "open", open)
+			require.NoError(t, err)
+			assert.True(t, decision.Allowed)
+			assert.Equal(t, confpkg.FailureModeOpen, decision.FailureMode)
+		}
+	})
+
+	t.Run("Fails closed", func(t *testing.T) {
+		closed := p
+		closed.FailureMode = confpkg.FailureModeClosed
+		_, err := repo.CheckRateLimit(ctx, "closed", closed)
+		assert.ErrorIs(t, err, cache.ErrUnavailable)
+
+		_, err = NewFailoverRepository(repo.Primary, nil).CheckRateLimit(ctx, "closed", p)
+		assert.ErrorIs(t, err, cache.ErrUnavailable, "without a local limiter")
+	})
+
+	t.Run("Does not fail over requests given up by their client", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := repo.CheckRateLimit(canceled, "canceled", p)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, cache.ErrUnavailable)
+	})
+}
+
+// failingRepository fails every check with err.
+type failingRepository struct{ err error }
+
+func (r failingRepository) CheckRateLimit(ctx context.Context, key string, policy entity.Policy) (*entity.Decision, error) {
+	return nil, r.err
+}
+
+func TestFailoverRepositoryErrors(t *testing.T) {
+	ctx := context.Background()
+	p := entity.Policy{Name: "api", Limit: 3, Window: time.Minute, FailureMode: confpkg.FailureModeOpen}
+
+	t.Run("Returns the errors of a healthy backend unchanged", func(t *testing.T) {
+		for _, err := range []error{cache.ErrNotInteger, cache.ErrTooManyConflicts, errors.New("decoding the state")} {
+			decision, got := NewFailoverRepository(failingRepository{err: err}, nil).CheckRateLimit(ctx, "key", p)
+			assert.Nil(t, decision)
+			assert.Equal(t, err, got)
+		}
+	})
+
+	t.Run("Fails over when the backend is unavailable", func(t *testing.T) {
+		unavailable := []error{
+			fmt.Errorf("%w: %w", cache.ErrUnavailable, breaker.ErrOpen),
+			context.DeadlineExceeded,
+			&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED},
+			io.EOF,
+		}
+		for _, err := range unavailable {
+			decision, got := NewFailoverRepository(failingRepository{err: err}, nil).CheckRateLimit(ctx, "key", p)
+			require.NoError(t, got, err)
+			assert.Equal(t, confpkg.FailureModeOpen, decision.FailureMode)
+		}
+	})
+}
+
+func TestLocalShare(t *testing.T) {
+	assert.Equal(t, 10, localShare(10, 0))
+	assert.Equal(t, 10, localShare(10, 1))
+	assert.Equal(t, 4, localShare(10, 3))
+	assert.Equal(t, 1, localShare(1, 5))
+}
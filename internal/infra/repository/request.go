@@ -2,46 +2,221 @@ package repository
 
 import (
 	"context"
-	"errors"
-	"github.com/go-redis/redis/v8"
-	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"fmt"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/ban"
 	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"strconv"
+	"sync"
 	"time"
 )
 
+var (
+	_ entity.RequestRepositoryInterface = (*RequestRepository)(nil)
+	_ entity.AdminRepositoryInterface   = (*RequestRepository)(nil)
+)
+
 type RequestRepository struct {
 	CacheClient cache.ClientInterface
+	// Strategy runs the policies that do not name an algorithm.
+	Strategy limiter.Strategy
+	// Bans holds the keys banned for exceeding their limit.
+	Bans *ban.Store
+
+	mu         sync.Mutex
+	strategies map[string]limiter.Strategy
 }
 
-func NewRequestRepository(cacheClient cache.ClientInterface) *RequestRepository {
-	return &RequestRepository{CacheClient: cacheClient}
+func NewRequestRepository(cacheClient cache.ClientInterface, strategy limiter.Strategy) *RequestRepository {
+	return &RequestRepository{CacheClient: cacheClient, Strategy: strategy, Bans: ban.NewStore(cacheClient)}
 }
 
-// CheckRateLimit checks if the request is allowed under the rate limit.
-func (r *RequestRepository) CheckRateLimit(key string, limit int) (bool, error) {
-	ctx := context.Background()
-	current, err := r.CacheClient.Get(ctx, key).Int()
-	if err != nil && !errors.Is(err, redis.Nil) {
-		return false, err
+// CheckRateLimit checks if the request is allowed under the policy using the strategy of its algorithm.
+// Requests to a banned key are rejected without being counted, restarting the ban when the policy extends it. A
+// request exceeding the limit bans its key for the policy Block, if any, or for the penalty escalating with the number
+// of times the key was banned within the policy PenaltyDecay.
+// Queueing strategies may delay the request for up to the policy MaxWait or until the context deadline, whichever
+// comes first.
+func (r *RequestRepository) CheckRateLimit(ctx context.Context, key string, policy entity.Policy) (*entity.Decision, error) {
+	strategy, err := r.strategy(policy.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := r.Bans.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		if policy.ExtendBan && b.Duration > 0 {
+			if b, err = r.Bans.Ban(ctx, key, b.Reason, b.Duration, b.Offenses); err != nil {
+				return nil, err
+			}
+		}
+		return &entity.Decision{
+			Allowed:    false,
+			Limit:      policy.Limit,
+			Window:     policy.Window,
+			ResetAt:    b.Until,
+			RetryAfter: time.Until(b.Until),
+			Policy:     policy.Name,
+			Ban:        b,
+		}, nil
+	}
+
+	l := limitOf(policy)
+	if deadline, ok := ctx.Deadline(); ok {
+		l.MaxWait = min(l.MaxWait, time.Until(deadline))
+	}
+
+	result, err := strategy.Allow(ctx, key, l)
+	if err != nil {
+		return nil, err
+	}
+
+	decision := &entity.Decision{
+		Allowed:    result.Allowed,
+		Limit:      policy.Limit,
+		Window:     policy.Window,
+		Remaining:  result.Remaining,
+		ResetAt:    time.Now().Add(result.ResetAfter),
+		RetryAfter: result.RetryAfter,
+		AdmitAt:    result.AdmitAt,
+		Policy:     policy.Name,
+	}
+	if result.Allowed || (policy.Block <= 0 && len(policy.Penalties) == 0) {
+		return decision, nil
+	}
+
+	offenses := 0
+	if len(policy.Penalties) > 0 {
+		if offenses, err = r.Bans.Offend(ctx, key, policy.PenaltyDecay); err != nil {
+			return nil, err
+		}
+	}
+	block := ban.Penalty(policy, offenses)
+	if block <= 0 {
+		return decision, nil
+	}
+
+	if decision.Ban, err = r.Bans.Ban(ctx, key, entity.BanReasonRateLimit, block, offenses); err != nil {
+		return nil, err
+	}
+	decision.RetryAfter = max(decision.RetryAfter, block)
+	decision.ResetAt = decision.Ban.Until
+	return decision, nil
+}
+
+// Usage returns the state of key under policy without counting a request.
+func (r *RequestRepository) Usage(ctx context.Context, key string, policy entity.Policy) (*entity.Usage, error) {
+	strategy, err := r.strategy(policy.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	inspector, ok := strategy.(limiter.Inspector)
+	if !ok {
+		return nil, fmt.Errorf("the %s algorithm cannot be inspected", policy.Algorithm)
+	}
+
+	result, err := inspector.Peek(ctx, key, limitOf(policy))
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.Bans.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &entity.Usage{
+		Key:     key,
+		Policy:  policy.Name,
+		Limit:   policy.Limit,
+		Window:  policy.Window,
+		ResetAt: time.Now().Add(result.ResetAfter),
+		Ban:     b,
 	}
+	if result.Allowed {
+		// The result describes the state after the peeked request.
+		usage.Remaining = result.Remaining + 1
+	}
+	usage.Used = max(policy.Limit-usage.Remaining, 0)
+	if b != nil {
+		usage.Remaining = 0
+		usage.ResetAt = b.Until
+	}
+	return usage, nil
+}
 
-	if current < limit {
-		_, err := r.CacheClient.Set(ctx, key, current+1, 1*time.Second).Result()
+// Reset forgets the requests counted for key under policy by every algorithm, as the policy may have changed its
+// algorithm since, along with its ban and its offenses.
+func (r *RequestRepository) Reset(ctx context.Context, key string, policy entity.Policy) error {
+	for _, algorithm := range limiter.Algorithms {
+		strategy, err := r.strategy(algorithm)
 		if err != nil {
-			return false, err
+			return err
 		}
-		return true, nil
+		if inspector, ok := strategy.(limiter.Inspector); ok {
+			if err := inspector.Reset(ctx, key, limitOf(policy)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.Bans.Lift(ctx, key); err != nil {
+		return err
 	}
+	return r.Bans.Forgive(ctx, key)
+}
 
-	delay := time.Duration(confpkg.Config.TimeoutDuration) * time.Second
-	_, err = r.CacheClient.Set(ctx, key, current+1, delay).Result()
-	return false, err
+// Ban bans key for d, replacing the ban in effect if any.
+func (r *RequestRepository) Ban(ctx context.Context, key, reason string, d time.Duration) (*entity.Ban, error) {
+	return r.Bans.Ban(ctx, key, reason, d, 0)
 }
 
-func (r *RequestRepository) SetRateLimit(key string, limit int) error {
-	res := r.CacheClient.Set(context.Background(), key, limit, time.Minute)
-	if res.Err() != nil {
-		return res.Err()
+// Unban lifts the ban of key, keeping its offenses.
+func (r *RequestRepository) Unban(ctx context.Context, key string) error {
+	return r.Bans.Lift(ctx, key)
+}
+
+// ListBans returns the bans in effect, or cache.ErrNotSupported when the backend cannot list its keys.
+func (r *RequestRepository) ListBans(ctx context.Context) ([]entity.Ban, error) {
+	return r.Bans.List(ctx)
+}
+
+func limitOf(policy entity.Policy) limiter.Limit {
+	return limiter.Limit{
+		Rate:      policy.Limit,
+		Period:    policy.Window,
+		Burst:     policy.Burst,
+		QueueSize: policy.QueueSize,
+		MaxWait:   policy.MaxWait,
+	}
+}
+
+// strategy returns the strategy running algorithm, creating it on first use.
+func (r *RequestRepository) strategy(algorithm string) (limiter.Strategy, error) {
+	if algorithm == "" {
+		return r.Strategy, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.strategies[algorithm]; ok {
+		return s, nil
+	}
+
+	s, err := limiter.New(algorithm, r.CacheClient)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if r.strategies == nil {
+		r.strategies = map[string]limiter.Strategy{}
+	}
+	r.strategies[algorithm] = s
+	return s, nil
+}
+
+func (r *RequestRepository) SetRateLimit(ctx context.Context, key string, limit int) error {
+	return r.CacheClient.Set(ctx, key, strconv.Itoa(limit), time.Minute)
 }
@@ -0,0 +1,351 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/redispkg"
+	"github.com/mayckol/rate-limiter/internal/infra/limiter"
+	"github.com/mayckol/rate-limiter/internal/infra/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRepository(t *testing.T) (*RequestRepository, *redis.Client) {
+	_, _, err := confpkg.LoadConfig(true)
+	require.NoError(t, err)
+
+	srv := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	client := redispkg.NewClient(rdb)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return NewRequestRepository(client, limiter.NewFixedWindow(client)), rdb
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	t.Run("Allows requests until the limit is reached", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+
+		for i := 0; i < 3; i++ {
+			decision, err := repo.CheckRateLimit(context.Background(), "rate_limiter_sequential", policy.Default(3))
+			assert.NoError(t, err)
+			assert.True(t, decision.Allowed)
+		}
+
+		decision, err := repo.CheckRateLimit(context.Background(), "rate_limiter_sequential", policy.Default(3))
+		assert.NoError(t, err)
+		assert.False(t, decision.Allowed)
+	})
+
+	t.Run("Describes the decision", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+
+		decision, err := repo.CheckRateLimit(context.Background(), "rate_limiter_decision", policy.Default(2))
+		assert.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, 2, decision.Limit)
+		assert.Equal(t, 1, decision.Remaining)
+		assert.Equal(t, policy.DefaultName, decision.Policy)
+		assert.WithinDuration(t, time.Now().Add(time.Second), decision.ResetAt, 100*time.Millisecond)
+		assert.Zero(t, decision.RetryAfter)
+
+		_, err = repo.CheckRateLimit(context.Background(), "rate_limiter_decision", policy.Default(2))
+		assert.NoError(t, err)
+
+		decision, err = repo.CheckRateLimit(context.Background(), "rate_limiter_decision", policy.Default(2))
+		assert.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, 0, decision.Remaining)
+		assert.Equal(t, time.Duration(confpkg.Current().TimeoutDuration)*time.Second, decision.RetryAfter)
+	})
+
+	t.Run("Does not over-admit concurrent requests", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+
+		const limit = 50
+		const workers = 500
+
+		var admitted int64
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				decision, err := repo.CheckRateLimit(context.Background(), "rate_limiter_concurrent", policy.Default(limit))
+				assert.NoError(t, err)
+				if decision != nil && decision.Allowed {
+					atomic.AddInt64(&admitted, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int64(limit), admitted)
+	})
+
+	t.Run("Does not over-admit concurrent requests on the in-memory backend", func(t *testing.T) {
+		_, _, err := confpkg.LoadConfig(true)
+		require.NoError(t, err)
+
+		client, err := memory.NewMemoryClient(&memory.ClientSettings{})
+		require.NoError(t, err)
+		defer client.Close()
+		repo := NewRequestRepository(client, limiter.NewFixedWindow(client))
+
+		const limit = 50
+		const workers = 500
+
+		var admitted int64
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				decision, err := repo.CheckRateLimit(context.Background(), "rate_limiter_concurrent", policy.Default(limit))
+				assert.NoError(t, err)
+				if decision != nil && decision.Allowed {
+					atomic.AddInt64(&admitted, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int64(limit), admitted)
+	})
+
+	t.Run("Falls back to EVAL when the script cache is empty", func(t *testing.T) {
+		repo, client := newTestRepository(t)
+
+		decision, err := repo.CheckRateLimit(context.Background(), "rate_limiter_noscript", policy.Default(2))
+		assert.NoError(t, err)
+		assert.True(t, decision.Allowed)
+
+		assert.NoError(t, client.ScriptFlush(context.Background()).Err())
+
+		decision, err = repo.CheckRateLimit(context.Background(), "rate_limiter_noscript", policy.Default(2))
+		assert.NoError(t, err)
+		assert.True(t, decision.Allowed)
+
+		decision, err = repo.CheckRateLimit(context.Background(), "rate_limiter_noscript", policy.Default(2))
+		assert.NoError(t, err)
+		assert.False(t, decision.Allowed)
+	})
+
+	t.Run("Applies the algorithm and window of the policy", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+		login := entity.Policy{Name: "login", Algorithm: limiter.AlgorithmSlidingLog, Limit: 2, Window: time.Minute}
+
+		for i := 0; i < 2; i++ {
+			decision, err := repo.CheckRateLimit(context.Background(), "rate_limiter_login_127001", login)
+			assert.NoError(t, err)
+			assert.True(t, decision.Allowed)
+			assert.Equal(t, "login", decision.Policy)
+			assert.Equal(t, time.Minute, decision.Window)
+		}
+
+		decision, err := repo.CheckRateLimit(context.Background(), "rate_limiter_login_127001", login)
+		assert.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.Greater(t, decision.RetryAfter, 50*time.Second)
+
+		_, err = repo.CheckRateLimit(context.Background(), "rate_limiter_login_127001", entity.Policy{Algorithm: "unknown", Limit: 1, Window: time.Second})
+		assert.Error(t, err)
+	})
+
+	t.Run("Bans the key apart from its counter", func(t *testing.T) {
+		repo, client := newTestRepository(t)
+		p := entity.Policy{Name: "ban", Limit: 1, Window: time.Minute, Block: time.Minute}
+
+		decision, err := repo.CheckRateLimit(context.Background(), "rate_limiter_ban", p)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Nil(t, decision.Ban)
+
+		decision, err = repo.CheckRateLimit(context.Background(), "rate_limiter_ban", p)
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		require.NotNil(t, decision.Ban)
+		assert.Equal(t, entity.BanReasonRateLimit, decision.Ban.Reason)
+		assert.Equal(t, time.Minute, decision.RetryAfter)
+		until := decision.Ban.Until
+
+		counter, err := client.Get(context.Background(), "rate_limiter_ban").Result()
+		require.NoError(t, err)
+		assert.Equal(t, "1", counter, "the rejected request must not be counted")
+
+		time.Sleep(20 * time.Millisecond)
+		decision, err = repo.CheckRateLimit(context.Background(), "rate_limiter_ban", p)
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, until, decision.Ban.Until, "the ban must not be extended")
+		assert.Less(t, decision.RetryAfter, time.Minute)
+
+		p.ExtendBan = true
+		decision, err = repo.CheckRateLimit(context.Background(), "rate_limiter_ban", p)
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.True(t, decision.Ban.Until.After(until), "the ban must be extended")
+
+		require.NoError(t, repo.Bans.Lift(context.Background(), "rate_limiter_ban"))
+		p.Limit = 2
+		decision, err = repo.CheckRateLimit(context.Background(), "rate_limiter_ban", p)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("Only rejects the requests over the limit without block", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+		p := entity.Policy{Name: "noblock", Limit: 1, Window: time.Minute}
+
+		_, err := repo.CheckRateLimit(context.Background(), "rate_limiter_noblock", p)
+		require.NoError(t, err)
+
+		decision, err := repo.CheckRateLimit(context.Background(), "rate_limiter_noblock", p)
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.Nil(t, decision.Ban)
+
+		b, err := repo.Bans.Get(context.Background(), "rate_limiter_noblock")
+		assert.NoError(t, err)
+		assert.Nil(t, b)
+	})
+
+	t.Run("Escalates the bans of repeat offenders", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+		p := entity.Policy{
+			Name:         "penalty",
+			Limit:        1,
+			Window:       time.Minute,
+			Block:        time.Second,
+			Penalties:    []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute},
+			PenaltyDecay: time.Hour,
+		}
+		ctx := context.Background()
+
+		_, err := repo.CheckRateLimit(ctx, "rate_limiter_penalty", p)
+		require.NoError(t, err)
+
+		for i, expected := range []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute, 10 * time.Minute} {
+			decision, err := repo.CheckRateLimit(ctx, "rate_limiter_penalty", p)
+			require.NoError(t, err)
+			assert.False(t, decision.Allowed)
+			require.NotNil(t, decision.Ban)
+			assert.Equal(t, expected, decision.Ban.Duration)
+			assert.Equal(t, i+1, decision.Ban.Offenses)
+			assert.GreaterOrEqual(t, decision.RetryAfter, expected)
+
+			require.NoError(t, repo.Bans.Lift(ctx, "rate_limiter_penalty"))
+		}
+	})
+
+	t.Run("Extends a ban for its own duration", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+		p := entity.Policy{Name: "extend", Limit: 1, Window: time.Minute, Penalties: []time.Duration{time.Hour}, ExtendBan: true}
+		ctx := context.Background()
+
+		_, err := repo.CheckRateLimit(ctx, "rate_limiter_extend", p)
+		require.NoError(t, err)
+		_, err = repo.CheckRateLimit(ctx, "rate_limiter_extend", p)
+		require.NoError(t, err)
+
+		decision, err := repo.CheckRateLimit(ctx, "rate_limiter_extend", p)
+		require.NoError(t, err)
+		require.NotNil(t, decision.Ban)
+		assert.Equal(t, time.Hour, decision.Ban.Duration)
+		assert.Equal(t, 1, decision.Ban.Offenses)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), decision.Ban.Until, time.Second)
+	})
+}
+
+func TestAdmin(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Reports the usage without counting a request", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+		p := entity.Policy{Name: "usage", Limit: 3, Window: time.Minute}
+
+		usage, err := repo.Usage(ctx, "rate_limiter_usage", p)
+		require.NoError(t, err)
+		assert.Equal(t, 0, usage.Used)
+		assert.Equal(t, 3, usage.Remaining)
+
+		_, err = repo.CheckRateLimit(ctx, "rate_limiter_usage", p)
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			usage, err = repo.Usage(ctx, "rate_limiter_usage", p)
+			require.NoError(t, err)
+			assert.Equal(t, 1, usage.Used)
+			assert.Equal(t, 2, usage.Remaining)
+			assert.Equal(t, "usage", usage.Policy)
+			assert.Nil(t, usage.Ban)
+		}
+	})
+
+	t.Run("Bans, unbans and lists the keys", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+		p := entity.Policy{Name: "ban", Limit: 3, Window: time.Minute}
+
+		b, err := repo.Ban(ctx, "rate_limiter_banned", entity.BanReasonAdmin, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, time.Hour, b.Duration)
+
+		decision, err := repo.CheckRateLimit(ctx, "rate_limiter_banned", p)
+		require.NoError(t, err)
+		assert.False(t, decision.Allowed)
+
+		usage, err := repo.Usage(ctx, "rate_limiter_banned", p)
+		require.NoError(t, err)
+		assert.Equal(t, 0, usage.Remaining)
+		if assert.NotNil(t, usage.Ban) {
+			assert.Equal(t, b.Until, usage.ResetAt)
+		}
+
+		bans, err := repo.ListBans(ctx)
+		require.NoError(t, err)
+		if assert.Len(t, bans, 1) {
+			assert.Equal(t, "rate_limiter_banned", bans[0].Key)
+			assert.Equal(t, entity.BanReasonAdmin, bans[0].Reason)
+		}
+
+		require.NoError(t, repo.Unban(ctx, "rate_limiter_banned"))
+		decision, err = repo.CheckRateLimit(ctx, "rate_limiter_banned", p)
+		require.NoError(t, err)
+		assert.True(t, decision.Allowed)
+	})
+
+	t.Run("Resets the counters, the ban and the offenses of a key", func(t *testing.T) {
+		repo, _ := newTestRepository(t)
+		p := entity.Policy{Name: "reset", Algorithm: limiter.AlgorithmSlidingWindow, Limit: 1, Window: time.Minute, Penalties: []time.Duration{time.Minute, time.Hour}}
+
+		for i := 0; i < 2; i++ {
+			_, err := repo.CheckRateLimit(ctx, "rate_limiter_reset", p)
+			require.NoError(t, err)
+		}
+		usage, err := repo.Usage(ctx, "rate_limiter_reset", p)
+		require.NoError(t, err)
+		require.NotNil(t, usage.Ban)
+
+		require.NoError(t, repo.Reset(ctx, "rate_limiter_reset", p))
+		usage, err = repo.Usage(ctx, "rate_limiter_reset", p)
+		require.NoError(t, err)
+		assert.Nil(t, usage.Ban)
+		assert.Equal(t, 1, usage.Remaining)
+
+		_, err = repo.CheckRateLimit(ctx, "rate_limiter_reset", p)
+		require.NoError(t, err)
+		decision, err := repo.CheckRateLimit(ctx, "rate_limiter_reset", p)
+		require.NoError(t, err)
+		if assert.NotNil(t, decision.Ban) {
+			assert.Equal(t, 1, decision.Ban.Offenses, "the offenses start over")
+		}
+	})
+}
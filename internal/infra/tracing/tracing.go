@@ -0,0 +1,178 @@
+// Package tracing traces the requests with OpenTelemetry: the HTTP server span continuing the W3C trace context of the
+// caller, the middlewares, the rate limit checks and the cache operations. Spans are exported by the exporter chosen
+// with TRACING_EXPORTER, and discarded when there is none.
+package tracing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/mayckol/rate-limiter"
+	serviceName         = "rate-limiter"
+)
+
+// Setup installs the W3C trace context propagator and the tracer provider exporting to exporter, one of the
+// TRACING_EXPORTER values. The OTLP exporter sends the spans over HTTP to OTEL_EXPORTER_OTLP_ENDPOINT,
+// http://localhost:4318 by default. The returned function flushes the spans left and stops the provider.
+func Setup(ctx context.Context, exporter string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	switch exporter {
+	case "", confpkg.TracingExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case confpkg.TracingExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx)
+	case confpkg.TracingExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the service name.
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of the rate limiter, from the global provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Middleware starts the server span of the requests, as a child of the span of the caller when the request carries a
+// traceparent header. The span is named after the chi pattern of the route once it is matched.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Tracer().Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		))
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(attribute.String("http.route", rctx.RoutePattern()))
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// KeyHash identifies key in the spans without exposing the IPs and tokens it is made of.
+func KeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// DecisionAttributes describe decision in a span.
+func DecisionAttributes(decision *entity.Decision) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("ratelimit.policy", decision.Policy),
+		attribute.Bool("ratelimit.allowed", decision.Allowed),
+		attribute.Int("ratelimit.limit", decision.Limit),
+		attribute.Int("ratelimit.remaining", decision.Remaining),
+	}
+	if decision.RetryAfter > 0 {
+		attrs = append(attrs, attribute.Float64("ratelimit.retry_after_seconds", decision.RetryAfter.Seconds()))
+	}
+	if decision.Ban != nil {
+		attrs = append(attrs, attribute.String("ratelimit.ban_reason", decision.Ban.Reason))
+	}
+	if decision.FailureMode != "" {
+		attrs = append(attrs, attribute.String("ratelimit.failure_mode", decision.FailureMode))
+	}
+	return attrs
+}
+
+// Fail marks span as failed because of err.
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Repository returns repository tracing its CheckRateLimit.
+func Repository(repository entity.RequestRepositoryInterface) entity.RequestRepositoryInterface {
+	return &tracedRepository{repository: repository}
+}
+
+type tracedRepository struct {
+	repository entity.RequestRepositoryInterface
+}
+
+func (r *tracedRepository) CheckRateLimit(ctx context.Context, key string, policy entity.Policy) (*entity.Decision, error) {
+	ctx, span := Tracer().Start(ctx, "RequestRepository.CheckRateLimit", trace.WithAttributes(
+		attribute.String("ratelimit.key_hash", KeyHash(key)),
+		attribute.String("ratelimit.policy", policy.Name),
+		attribute.Int("ratelimit.limit", policy.Limit),
+	))
+	defer span.End()
+
+	decision, err := r.repository.CheckRateLimit(ctx, key, policy)
+	if err != nil {
+		Fail(span, err)
+		return nil, err
+	}
+	span.SetAttributes(DecisionAttributes(decision)...)
+	return decision, nil
+}
+
+// Cache returns client tracing its operations, with the same optional interfaces as client. Missing keys and
+// concurrent modifications are expected by the strategies and do not fail the spans.
+func Cache(client cache.ClientInterface) cache.ClientInterface {
+	return cache.Wrap(client, func(ctx context.Context, operation string) (context.Context, func(error), error) {
+		ctx, span := Tracer().Start(ctx, "cache."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+			attribute.String("cache.operation", operation),
+		))
+		return ctx, func(err error) {
+			if err != nil && !errors.Is(err, cache.ErrNotFound) && !errors.Is(err, cache.ErrConflict) {
+				Fail(span, err)
+			}
+			span.End()
+		}, nil
+	})
+}
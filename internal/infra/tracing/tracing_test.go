@@ -0,0 +1,138 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	confpkg "github.com/mayckol/rate-limiter/configpkg"
+	"github.com/mayckol/rate-limiter/internal/entity"
+	"github.com/mayckol/rate-limiter/internal/infra/cache"
+	"github.com/mayckol/rate-limiter/internal/infra/cache/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// record installs a tracer provider keeping the spans in memory until the end of the test.
+func record(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+type repositoryFunc func(ctx context.Context, key string, policy entity.Policy) (*entity.Decision, error)
+
+func (f repositoryFunc) CheckRateLimit(ctx context.Context, key string, policy entity.Policy) (*entity.Decision, error) {
+	return f(ctx, key, policy)
+}
+
+func TestSetup(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+
+	for _, exporter := range []string{"", confpkg.TracingExporterNone, confpkg.TracingExporterOTLP} {
+		shutdown, err := Setup(context.Background(), exporter)
+		require.NoError(t, err, exporter)
+		assert.NoError(t, shutdown(context.Background()), exporter)
+	}
+
+	_, err := Setup(context.Background(), "jaeger")
+	assert.Error(t, err)
+}
+
+func TestMiddleware(t *testing.T) {
+	recorder := record(t)
+	_, err := Setup(context.Background(), "")
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Use(Middleware)
+	r.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	req := httptest.NewRequest("GET", "/items/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "GET /items/{id}", spans[0].Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+	attrs := attributes(spans[0])
+	assert.Equal(t, "/items/{id}", attrs["http.route"].AsString())
+	assert.Equal(t, int64(http.StatusTooManyRequests), attrs["http.response.status_code"].AsInt64())
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+}
+
+func TestRepository(t *testing.T) {
+	recorder := record(t)
+	repo := Repository(repositoryFunc(func(ctx context.Context, key string, policy entity.Policy) (*entity.Decision, error) {
+		if key == "broken" {
+			return nil, errors.New("cache is down")
+		}
+		return &entity.Decision{Allowed: false, Limit: policy.Limit, Remaining: 0, RetryAfter: time.Second, Policy: policy.Name}, nil
+	}))
+
+	_, err := repo.CheckRateLimit(context.Background(), "rate_limiter_127.0.0.1", entity.Policy{Name: "default", Limit: 3})
+	require.NoError(t, err)
+	_, err = repo.CheckRateLimit(context.Background(), "broken", entity.Policy{Name: "default", Limit: 3})
+	require.Error(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "RequestRepository.CheckRateLimit", spans[0].Name())
+	attrs := attributes(spans[0])
+	assert.Equal(t, KeyHash("rate_limiter_127.0.0.1"), attrs["ratelimit.key_hash"].AsString())
+	assert.NotContains(t, attrs["ratelimit.key_hash"].AsString(), "127.0.0.1")
+	assert.False(t, attrs["ratelimit.allowed"].AsBool())
+	assert.Equal(t, int64(3), attrs["ratelimit.limit"].AsInt64())
+	assert.Equal(t, int64(0), attrs["ratelimit.remaining"].AsInt64())
+	assert.Equal(t, 1.0, attrs["ratelimit.retry_after_seconds"].AsFloat64())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}
+
+func TestCache(t *testing.T) {
+	recorder := record(t)
+	mem, err := memory.NewMemoryClient(&memory.ClientSettings{})
+	require.NoError(t, err)
+	defer mem.Close()
+	client := Cache(mem)
+	assert.Implements(t, (*cache.Updater)(nil), client)
+
+	ctx, parent := Tracer().Start(context.Background(), "parent")
+	_, err = client.Get(ctx, "missing")
+	require.ErrorIs(t, err, cache.ErrNotFound)
+	_, err = client.Increment(ctx, "key", 1, time.Minute)
+	require.NoError(t, err)
+	parent.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "cache.get", spans[0].Name())
+	assert.Equal(t, codes.Unset, spans[0].Status().Code, "a missing key is not a failure")
+	assert.Equal(t, "cache.increment", spans[1].Name())
+	for _, span := range spans[:2] {
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+}
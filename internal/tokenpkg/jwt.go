@@ -2,6 +2,8 @@
 package tokenpkg
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/golang-jwt/jwt/v5"
 	confpkg "github.com/mayckol/rate-limiter/configpkg"
 	"time"
@@ -11,18 +13,28 @@ import (
 type Claims struct {
 	IP           string `json:"ip"`
 	MaxReqPerSec int    `json:"max_req_per_sec"`
+	// BlockSec overrides the ban duration of the requests limited by the token identity when greater than zero.
+	BlockSec int `json:"block_sec,omitempty"`
 	jwt.RegisteredClaims
 }
 
 // NewJWT generates a new JWT token string.
 // The token will expire after the specified duration.
-// The token will contain the IP and the maximum number of requests per second.
-func NewJWT(ip string, expirationDuration time.Duration, maxReqPerSec int) (string, error) {
+// The token will contain the IP, the maximum number of requests per second, the ban duration in seconds when greater
+// than zero, and a random ID (jti) the requests carrying it are limited by.
+func NewJWT(ip string, expirationDuration time.Duration, maxReqPerSec int, blockSec int) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
 	expirationTime := time.Now().Add(expirationDuration)
 	claims := &Claims{
 		IP:           ip,
 		MaxReqPerSec: maxReqPerSec,
+		BlockSec:     blockSec,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
@@ -33,6 +45,18 @@ func NewJWT(ip string, expirationDuration time.Duration, maxReqPerSec int) (stri
 	return tokenString, nil
 }
 
+// Identity returns the identity the requests carrying the token are limited by: its sub claim, or its jti when it has
+// no subject. It is empty for the claims of requests without a token.
+func (c *Claims) Identity() string {
+	if c.Subject != "" {
+		return "sub:" + c.Subject
+	}
+	if c.ID != "" {
+		return "jti:" + c.ID
+	}
+	return ""
+}
+
 func JwtKey() []byte {
-	return []byte(confpkg.Config.JWTKey)
+	return []byte(confpkg.Current().JWTKey)
 }
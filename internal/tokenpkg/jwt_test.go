@@ -20,7 +20,7 @@ func TestNewJWTGenerates(t *testing.T) {
 		expirationDuration := 5 * time.Minute
 		maxReqPerSec := 10
 
-		tokenString, err := NewJWT(testIP, expirationDuration, maxReqPerSec)
+		tokenString, err := NewJWT(testIP, expirationDuration, maxReqPerSec, 0)
 		assert.NoError(t, err, "Expected no error")
 
 		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
@@ -33,6 +33,9 @@ func TestNewJWTGenerates(t *testing.T) {
 		if claims, ok := token.Claims.(*Claims); ok {
 			assert.Equal(t, testIP, claims.IP, "IP should match")
 			assert.Equal(t, maxReqPerSec, claims.MaxReqPerSec, "MaxReqPerSec should match")
+			assert.Len(t, claims.ID, 32, "ID should be set")
+			assert.Zero(t, claims.BlockSec, "BlockSec should be omitted")
+			assert.Equal(t, "jti:"+claims.ID, claims.Identity())
 		} else {
 			t.Fatal("Expected claims to be of type *Claims")
 		}
@@ -42,7 +45,7 @@ func TestNewJWTGenerates(t *testing.T) {
 		expirationDuration := 5 * time.Minute
 		maxReqPerSec := 0
 
-		tokenString, err := NewJWT(testIP, expirationDuration, maxReqPerSec)
+		tokenString, err := NewJWT(testIP, expirationDuration, maxReqPerSec, 0)
 		assert.NoError(t, err, "Expected no error")
 
 		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
@@ -58,3 +61,35 @@ func TestNewJWTGenerates(t *testing.T) {
 		}
 	})
 }
+
+func TestClaimsIdentity(t *testing.T) {
+	claims := &Claims{IP: testIP}
+	assert.Empty(t, claims.Identity())
+
+	claims.ID = "id"
+	assert.Equal(t, "jti:id", claims.Identity())
+
+	claims.Subject = "user"
+	assert.Equal(t, "sub:user", claims.Identity())
+
+	first, err := NewJWT(testIP, time.Minute, 1, 0)
+	assert.NoError(t, err)
+	second, err := NewJWT(testIP, time.Minute, 1, 0)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second, "Tokens should have distinct IDs")
+}
+
+func TestNewJWTBlockSec(t *testing.T) {
+	_, _, err := confpkg.LoadConfig(true)
+	assert.NoError(t, err)
+
+	tokenString, err := NewJWT(testIP, time.Minute, 10, 30)
+	assert.NoError(t, err)
+
+	claims := &Claims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return JwtKey(), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 30, claims.BlockSec)
+}